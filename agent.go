@@ -3,15 +3,11 @@ package consulapi
 import (
 	"context"
 	"encoding/json"
-	"errors"
-	"io"
 	"net/http"
-	"os"
+	"net/url"
 	"time"
 )
 
-var errUpdateTTL = errors.New("update ttl failed")
-
 // ServiceKind is the kind of service being registered.
 type ServiceKind string
 
@@ -47,6 +43,15 @@ type AgentConnectAuthorizeResponse struct {
 	Reason     string
 }
 
+// AgentConnectCALeafRequest fetches the leaf certificate of a service.  When
+// WaitIndex is set, the request blocks until the certificate is renewed or
+// WaitTime elapses.
+type AgentConnectCALeafRequest struct {
+	Service   string
+	WaitIndex int64
+	WaitTime  time.Duration
+}
+
 type AgentConnectCALeaf struct {
 	SerialNumber  string
 	CertPEM       string
@@ -73,15 +78,27 @@ type AgentConnectCARoot struct {
 	ModifyIndex       int64
 }
 
+// AgentConnectCARootsRequest fetches the CA roots.  When WaitIndex is set,
+// the request blocks until the roots change or WaitTime elapses.
+type AgentConnectCARootsRequest struct {
+	WaitIndex int64
+	WaitTime  time.Duration
+}
+
 type AgentConnectCARoots struct {
 	ActiveRootID string
 	TrustDomain  string
 	Roots        []AgentConnectCARoot
+	Index        int64 `json:"-"`
 }
 
 type AgentServiceCheck struct {
 	CheckID                        string `json:",omitempty"`
+	Name                           string `json:",omitempty"`
+	Notes                          string `json:",omitempty"`
 	TTL                            string `json:",omitempty"`
+	GRPC                           string `json:",omitempty"`
+	Interval                       string `json:",omitempty"`
 	DeregisterCriticalServiceAfter string `json:",omitempty"`
 }
 
@@ -89,13 +106,32 @@ type AgentServiceCheck struct {
 // ServiceDefinition or response.
 type AgentServiceProxy struct {
 	DestinationServiceName string
-	DestinationServiceID   string `json:",omitempty"`
-	LocalServiceAddress    string `json:",omitempty"`
-	LocalServicePort       int    `json:",omitempty"`
+	DestinationServiceID   string                 `json:",omitempty"`
+	LocalServiceAddress    string                 `json:",omitempty"`
+	LocalServicePort       int                    `json:",omitempty"`
+	Upstreams              []AgentServiceUpstream `json:",omitempty"`
+}
+
+// AgentServiceUpstream is an upstream service of a connect-proxy, a local
+// port on which the proxy accepts connections for a connect service.
+type AgentServiceUpstream struct {
+	DestinationType  string `json:",omitempty"`
+	DestinationName  string
+	Datacenter       string `json:",omitempty"`
+	LocalBindAddress string `json:",omitempty"`
+	LocalBindPort    int
+}
+
+// AgentWeights are the load balancing weights of a service while its checks
+// are passing or warning.
+type AgentWeights struct {
+	Passing int
+	Warning int
 }
 
 type AgentServiceConnect struct {
-	Native bool
+	Native         bool
+	SidecarService *AgentServiceRegistration `json:",omitempty"`
 }
 
 type AgentServiceRegistration struct {
@@ -103,9 +139,12 @@ type AgentServiceRegistration struct {
 	ID               string               `json:",omitempty"`
 	Name             string               `json:",omitempty"`
 	Tags             []string             `json:",omitempty"`
+	Meta             map[string]string    `json:",omitempty"`
+	Weights          *AgentWeights        `json:",omitempty"`
 	Port             int                  `json:",omitempty"`
 	Address          string               `json:",omitempty"`
 	Check            *AgentServiceCheck   `json:",omitempty"`
+	Checks           []*AgentServiceCheck `json:",omitempty"`
 	Connect          *AgentServiceConnect `json:",omitempty"`
 	ProxyDestination string               `json:",omitempty"`
 	Proxy            *AgentServiceProxy   `json:",omitempty"`
@@ -132,13 +171,27 @@ func (a *Agent) ConnectAuthorize(ctx context.Context, input AgentConnectAuthoriz
 }
 
 func (a *Agent) ConnectCALeaf(ctx context.Context, service string) (AgentConnectCALeaf, error) {
-	path := "/v1/agent/connect/ca/leaf/" + service
+	return a.ConnectCALeafQuery(ctx, AgentConnectCALeafRequest{Service: service})
+}
+
+func (a *Agent) ConnectCALeafQuery(ctx context.Context, input AgentConnectCALeafRequest) (AgentConnectCALeaf, error) {
+	query := url.Values{}
+	setWait(query, input.WaitIndex, input.WaitTime)
+
+	path := "/v1/agent/connect/ca/leaf/" + url.PathEscape(input.Service)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
 	resp, err := a.client.Request(ctx, http.MethodGet, path, nil)
 	if err != nil {
 		return AgentConnectCALeaf{}, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return AgentConnectCALeaf{}, newAgentError(resp)
+	}
+
 	var output AgentConnectCALeaf
 	if err := json.NewDecoder(resp.Body).Decode(&output); err != nil {
 		return AgentConnectCALeaf{}, err
@@ -148,17 +201,32 @@ func (a *Agent) ConnectCALeaf(ctx context.Context, service string) (AgentConnect
 }
 
 func (a *Agent) ConnectCARoots(ctx context.Context) (AgentConnectCARoots, error) {
-	const path = "/v1/agent/connect/ca/roots"
+	return a.ConnectCARootsQuery(ctx, AgentConnectCARootsRequest{})
+}
+
+func (a *Agent) ConnectCARootsQuery(ctx context.Context, input AgentConnectCARootsRequest) (AgentConnectCARoots, error) {
+	query := url.Values{}
+	setWait(query, input.WaitIndex, input.WaitTime)
+
+	path := "/v1/agent/connect/ca/roots"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
 	resp, err := a.client.Request(ctx, http.MethodGet, path, nil)
 	if err != nil {
 		return AgentConnectCARoots{}, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return AgentConnectCARoots{}, newAgentError(resp)
+	}
+
 	var output AgentConnectCARoots
 	if err := json.NewDecoder(resp.Body).Decode(&output); err != nil {
 		return AgentConnectCARoots{}, err
 	}
+	output.Index = parseIndex(resp)
 
 	return output, nil
 }
@@ -179,7 +247,9 @@ func (a *Agent) ServiceRegister(ctx context.Context, registration AgentServiceRe
 	}
 	defer resp.Body.Close()
 
-	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return newAgentError(resp)
+	}
 
 	return nil
 }
@@ -192,6 +262,10 @@ func (a *Agent) ServiceDeregister(ctx context.Context, serviceID string) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return newAgentError(resp)
+	}
+
 	return nil
 }
 
@@ -212,7 +286,7 @@ func (a *Agent) UpdateTTL(ctx context.Context, status Status, checkID, output st
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errUpdateTTL
+		return newAgentError(resp)
 	}
 
 	return nil
@@ -2,6 +2,7 @@ package consulapi
 
 import (
 	"context"
+	"net/http"
 	"testing"
 )
 
@@ -157,3 +158,27 @@ func TestAgent_ConnectAuthorize(t *testing.T) {
 		t.Fatalf("got blank string; want not blank string")
 	}
 }
+
+func TestAgent_ConnectCAError(t *testing.T) {
+	addr := newTestServer(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	})
+
+	var (
+		ctx   = context.Background()
+		agent = NewAgent(WithConsulAddr(addr))
+	)
+
+	_, leafErr := agent.ConnectCALeafQuery(ctx, AgentConnectCALeafRequest{Service: "web"})
+	_, rootsErr := agent.ConnectCARootsQuery(ctx, AgentConnectCARootsRequest{})
+
+	for _, err := range []error{leafErr, rootsErr} {
+		agentErr, ok := err.(*AgentError)
+		if !ok {
+			t.Fatalf("got %v; want *AgentError", err)
+		}
+		if got, want := agentErr.StatusCode, http.StatusForbidden; got != want {
+			t.Fatalf("got %v; want %v", got, want)
+		}
+	}
+}
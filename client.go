@@ -7,42 +7,43 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
-	"sync/atomic"
+	"time"
 )
 
 type client struct {
-	consulAddr  string
-	consulIndex int64
-	hostAddr    string
+	consulAddr string
+	hostAddr   string
 }
 
 func (c *client) makeURL(path string) string {
-	var index string
-	if v := atomic.LoadInt64(&c.consulIndex); v > 0 {
-		if strings.Contains(path, "?") {
-			index = "&index=" + strconv.FormatInt(v, 10)
-		} else {
-			index = "?index=" + strconv.FormatInt(v, 10)
-		}
-	}
-	return "http://" + c.consulAddr + path + index
+	return "http://" + c.consulAddr + path
 }
 
 func (c *client) Do(req *http.Request) (*http.Response, error) {
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
+	return http.DefaultClient.Do(req)
+}
 
-	if str := resp.Header.Get("X-Consul-Index"); str != "" {
-		if v, err := strconv.ParseInt(str, 10, 64); err == nil {
-			atomic.StoreInt64(&c.consulIndex, v)
-		}
+// setWait adds the parameters of a blocking query to query.  Blocking is
+// disabled when index is 0.
+func setWait(query url.Values, index int64, wait time.Duration) {
+	if index <= 0 {
+		return
+	}
+	query.Set("index", strconv.FormatInt(index, 10))
+	if wait > 0 {
+		query.Set("wait", strconv.FormatInt(int64(wait/time.Millisecond), 10)+"ms")
 	}
+}
 
-	return resp, nil
+// parseIndex returns the X-Consul-Index of the response or 0 if absent.
+func parseIndex(resp *http.Response) int64 {
+	v, err := strconv.ParseInt(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
 }
 
 func (c *client) Request(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
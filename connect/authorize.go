@@ -0,0 +1,175 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/savaki/consulapi"
+	"github.com/savaki/consulapi/connect/spiffe"
+)
+
+const (
+	defaultAuthorizationTTL     = 10 * time.Second
+	defaultAuthorizationTimeout = 5 * time.Second
+)
+
+// AuthorizeAPI checks connect intentions with the consul agent.
+type AuthorizeAPI interface {
+	ConnectAuthorize(ctx context.Context, input consulapi.AgentConnectAuthorizeRequest) (consulapi.AgentConnectAuthorizeResponse, error)
+}
+
+// AuthorizationError is returned when the intentions of the consul agent deny
+// a client access to a service.
+type AuthorizationError struct {
+	Target        string
+	ClientCertURI string
+	Reason        string
+}
+
+func (e *AuthorizationError) Error() string {
+	return fmt.Sprintf("connect: %v is not authorized to connect to %v: %v", e.ClientCertURI, e.Target, e.Reason)
+}
+
+type authorization struct {
+	authorized bool
+	reason     string
+	expires    time.Time
+}
+
+// Authorizer decides whether clients may connect to a service using the
+// connect intentions of the consul agent.  Decisions are cached briefly so
+// clients that open many connections do not each require a round trip to
+// the agent.
+type Authorizer struct {
+	agent   AuthorizeAPI
+	target  string
+	options authorizerOptions
+
+	mutex sync.Mutex
+	cache map[string]authorization
+}
+
+// encodeSerial formats a certificate serial number as consul does, as colon
+// separated hex bytes.
+func encodeSerial(serial *big.Int) string {
+	data := serial.Bytes()
+	parts := make([]string, 0, len(data))
+	for _, b := range data {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+func (a *Authorizer) lookup(key string) (authorization, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	v, ok := a.cache[key]
+	if !ok || time.Now().After(v.expires) {
+		return authorization{}, false
+	}
+	return v, true
+}
+
+func (a *Authorizer) store(key string, v authorization) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	for k, existing := range a.cache {
+		if now.After(existing.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = v
+}
+
+// AuthorizeCertificate checks whether the client presenting cert may connect
+// to the target service.
+func (a *Authorizer) AuthorizeCertificate(ctx context.Context, cert *x509.Certificate) error {
+	id, err := spiffe.FromCertificate(cert)
+	if err != nil {
+		return err
+	}
+	uri := id.String()
+
+	serial := encodeSerial(cert.SerialNumber)
+	key := uri + "|" + serial
+
+	v, ok := a.lookup(key)
+	if !ok {
+		output, err := a.agent.ConnectAuthorize(ctx, consulapi.AgentConnectAuthorizeRequest{
+			Target:           a.target,
+			ClientCertURI:    uri,
+			ClientCertSerial: serial,
+		})
+		if err != nil {
+			if a.options.failOpen {
+				return nil
+			}
+			return err
+		}
+
+		v = authorization{
+			authorized: output.Authorized,
+			reason:     output.Reason,
+			expires:    time.Now().Add(a.options.ttl),
+		}
+		a.store(key, v)
+	}
+
+	if !v.authorized {
+		return &AuthorizationError{
+			Target:        a.target,
+			ClientCertURI: uri,
+			Reason:        v.reason,
+		}
+	}
+
+	return nil
+}
+
+// Authorize checks whether the client of an established tls connection may
+// connect to the target service.
+func (a *Authorizer) Authorize(ctx context.Context, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errNoCertificates
+	}
+	return a.AuthorizeCertificate(ctx, state.PeerCertificates[0])
+}
+
+// VerifyConnection may be assigned to tls.Config.VerifyConnection to reject
+// unauthorized clients during the handshake e.g.
+//
+//	config := source.ServerTLSConfig()
+//	config.VerifyConnection = authorizer.VerifyConnection
+func (a *Authorizer) VerifyConnection(state tls.ConnectionState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.options.timeout)
+	defer cancel()
+
+	return a.Authorize(ctx, state)
+}
+
+// NewAuthorizer returns an Authorizer for connections to the target service.
+func NewAuthorizer(agent AuthorizeAPI, target string, opts ...AuthorizerOption) *Authorizer {
+	options := authorizerOptions{
+		ttl:     defaultAuthorizationTTL,
+		timeout: defaultAuthorizationTimeout,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &Authorizer{
+		agent:   agent,
+		target:  target,
+		options: options,
+		cache:   map[string]authorization{},
+	}
+}
@@ -0,0 +1,158 @@
+package connect
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/savaki/consulapi"
+)
+
+type AuthorizeMock struct {
+	mutex   sync.Mutex
+	allowed map[string]bool // keyed by service name
+	err     error
+	inputs  []consulapi.AgentConnectAuthorizeRequest
+}
+
+func (m *AuthorizeMock) ConnectAuthorize(ctx context.Context, input consulapi.AgentConnectAuthorizeRequest) (consulapi.AgentConnectAuthorizeResponse, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.inputs = append(m.inputs, input)
+	if m.err != nil {
+		return consulapi.AgentConnectAuthorizeResponse{}, m.err
+	}
+
+	service := input.ClientCertURI[strings.LastIndex(input.ClientCertURI, "/")+1:]
+	if m.allowed[service] {
+		return consulapi.AgentConnectAuthorizeResponse{Authorized: true, Reason: "allowed"}, nil
+	}
+	return consulapi.AgentConnectAuthorizeResponse{Authorized: false, Reason: "denied by intention"}, nil
+}
+
+func (m *AuthorizeMock) calls() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.inputs)
+}
+
+func parseLeaf(t *testing.T, leaf consulapi.AgentConnectCALeaf) *x509.Certificate {
+	block, _ := pem.Decode([]byte(leaf.CertPEM))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	return cert
+}
+
+func TestEncodeSerial(t *testing.T) {
+	if got, want := encodeSerial(big.NewInt(0x0a0b0c)), "0a:0b:0c"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		ca   = NewTestCA(t, testTrustDomain)
+		web  = parseLeaf(t, ca.Leaf("web", time.Hour))
+		evil = parseLeaf(t, ca.Leaf("evil", time.Hour))
+		m    = &AuthorizeMock{allowed: map[string]bool{"web": true}}
+		a    = NewAuthorizer(m, "db")
+	)
+
+	if err := a.AuthorizeCertificate(ctx, web); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if err := a.AuthorizeCertificate(ctx, web); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := m.calls(), 1; got != want {
+		t.Fatalf("got %v; want %v (cached)", got, want)
+	}
+
+	input := m.inputs[0]
+	if got, want := input.Target, "db"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := input.ClientCertSerial, encodeSerial(web.SerialNumber); got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	err := a.AuthorizeCertificate(ctx, evil)
+	var authErr *AuthorizationError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("got %v; want *AuthorizationError", err)
+	}
+	if got, want := authErr.Reason, "denied by intention"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestAuthorizer_TTL(t *testing.T) {
+	var (
+		ctx = context.Background()
+		ca  = NewTestCA(t, testTrustDomain)
+		web = parseLeaf(t, ca.Leaf("web", time.Hour))
+		m   = &AuthorizeMock{allowed: map[string]bool{"web": true}}
+		a   = NewAuthorizer(m, "db", WithAuthorizationTTL(time.Millisecond))
+	)
+
+	if err := a.AuthorizeCertificate(ctx, web); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := a.AuthorizeCertificate(ctx, web); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := m.calls(), 2; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestAuthorizer_AgentUnavailable(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		ca    = NewTestCA(t, testTrustDomain)
+		web   = parseLeaf(t, ca.Leaf("web", time.Hour))
+		agent = errors.New("agent unavailable")
+		m     = &AuthorizeMock{err: agent}
+	)
+
+	if err := NewAuthorizer(m, "db").AuthorizeCertificate(ctx, web); err != agent {
+		t.Fatalf("got %v; want %v", err, agent)
+	}
+	if err := NewAuthorizer(m, "db", WithFailOpen(true)).AuthorizeCertificate(ctx, web); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+}
+
+func TestAuthorizer_VerifyConnection(t *testing.T) {
+	var (
+		ca     = NewTestCA(t, testTrustDomain)
+		server = newTestTLSSource(t, ca, "db")
+		web    = newTestTLSSource(t, ca, "web")
+		evil   = newTestTLSSource(t, ca, "evil")
+		m      = &AuthorizeMock{allowed: map[string]bool{"web": true}}
+	)
+
+	config := server.ServerTLSConfig()
+	config.VerifyConnection = NewAuthorizer(m, "db").VerifyConnection
+
+	if serverErr, _ := handshake(config, web.ClientTLSConfig("db")); serverErr != nil {
+		t.Fatalf("got %v; want nil", serverErr)
+	}
+
+	serverErr, _ := handshake(config, evil.ClientTLSConfig("db"))
+	var authErr *AuthorizationError
+	if !errors.As(serverErr, &authErr) {
+		t.Fatalf("got %v; want *AuthorizationError", serverErr)
+	}
+}
@@ -0,0 +1,92 @@
+package connect
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+// WeightedRoundRobin is the name of a grpc load balancing policy that
+// distributes requests across the addresses of the consul resolver in
+// proportion to their consul service weights e.g.
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingPolicy":"consul_weighted_round_robin"}`)
+//
+// Addresses without an Instance attribute receive a weight of 1.
+const WeightedRoundRobin = "consul_weighted_round_robin"
+
+func init() {
+	balancer.Register(base.NewBalancerBuilderV2(WeightedRoundRobin, &wrrPickerBuilder{}, base.Config{HealthCheck: true}))
+}
+
+type wrrPickerBuilder struct{}
+
+func (*wrrPickerBuilder) Build(info base.PickerBuildInfo) balancer.V2Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(balancer.ErrNoSubConnAvailable)
+	}
+
+	var (
+		entries []*wrrEntry
+		total   int
+	)
+	for sc, scInfo := range info.ReadySCs {
+		weight := 1
+		if instance, ok := InstanceFromAddress(scInfo.Address); ok {
+			weight = instance.Weight
+		}
+		if weight <= 0 {
+			continue
+		}
+
+		entries = append(entries, &wrrEntry{subConn: sc, weight: weight})
+		total += weight
+	}
+
+	// every ready instance has a weight of 0; prefer an even distribution to
+	// failing every request
+	if len(entries) == 0 {
+		for sc := range info.ReadySCs {
+			entries = append(entries, &wrrEntry{subConn: sc, weight: 1})
+			total++
+		}
+	}
+
+	return &wrrPicker{
+		entries: entries,
+		total:   total,
+	}
+}
+
+type wrrEntry struct {
+	subConn balancer.SubConn
+	weight  int
+	current int
+}
+
+// wrrPicker implements smooth weighted round robin, which interleaves the
+// picks of heavier instances with those of lighter ones rather than sending
+// them in bursts.
+type wrrPicker struct {
+	entries []*wrrEntry
+	total   int
+
+	mutex sync.Mutex
+}
+
+func (p *wrrPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var selected *wrrEntry
+	for _, entry := range p.entries {
+		entry.current += entry.weight
+		if selected == nil || entry.current > selected.current {
+			selected = entry
+		}
+	}
+	selected.current -= p.total
+
+	return balancer.PickResult{SubConn: selected.subConn}, nil
+}
@@ -0,0 +1,108 @@
+package connect
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+type SubConn struct {
+	balancer.SubConn
+	name string
+}
+
+func weightedAddress(weight int) resolver.Address {
+	return resolver.Address{
+		Attributes: attributes.New(instanceKey{}, Instance{Weight: weight}),
+	}
+}
+
+func pickCounts(t *testing.T, picker balancer.V2Picker, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		result, err := picker.Pick(balancer.PickInfo{})
+		if err != nil {
+			t.Fatalf("got %v; want nil", err)
+		}
+		counts[result.SubConn.(*SubConn).name]++
+	}
+	return counts
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	var (
+		a = &SubConn{name: "a"}
+		b = &SubConn{name: "b"}
+		c = &SubConn{name: "c"}
+	)
+
+	picker := (&wrrPickerBuilder{}).Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			a: {Address: weightedAddress(5)},
+			b: {Address: weightedAddress(1)},
+			c: {Address: weightedAddress(0)},
+		},
+	})
+
+	counts := pickCounts(t, picker, 60)
+	if got, want := counts["a"], 50; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := counts["b"], 10; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got := counts["c"]; got != 0 {
+		t.Fatalf("got %v; want 0", got)
+	}
+}
+
+func TestWeightedRoundRobin_AllZero(t *testing.T) {
+	var (
+		a = &SubConn{name: "a"}
+		b = &SubConn{name: "b"}
+	)
+
+	picker := (&wrrPickerBuilder{}).Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			a: {Address: weightedAddress(0)},
+			b: {Address: weightedAddress(0)},
+		},
+	})
+
+	counts := pickCounts(t, picker, 10)
+	if got, want := counts["a"], 5; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := counts["b"], 5; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestWeightedRoundRobin_NoInstance(t *testing.T) {
+	var (
+		a = &SubConn{name: "a"}
+		b = &SubConn{name: "b"}
+	)
+
+	picker := (&wrrPickerBuilder{}).Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			a: {Address: weightedAddress(3)},
+			b: {Address: resolver.Address{}},
+		},
+	})
+
+	counts := pickCounts(t, picker, 8)
+	if got, want := counts["b"], 2; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestWeightedRoundRobin_NoSubConns(t *testing.T) {
+	picker := (&wrrPickerBuilder{}).Build(base.PickerBuildInfo{})
+	if _, err := picker.Pick(balancer.PickInfo{}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("got %v; want %v", err, balancer.ErrNoSubConnAvailable)
+	}
+}
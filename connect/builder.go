@@ -0,0 +1,247 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/savaki/consulapi"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme is the grpc target scheme handled by the consul resolver.Builder e.g.
+//
+//	consul://localhost:8500/my-service?tag=v2&dc=east
+const Scheme = "consul"
+
+var errMissingService = errors.New("consul resolver: target does not specify a service")
+
+func init() {
+	resolver.Register(NewBuilder())
+}
+
+type instanceKey struct{}
+
+// Instance describes the consul service instance behind a resolved address.
+// Weight is the relative share of requests the instance should receive as
+// given by the consul service weights; Warning is set when any of its checks
+// is warning, which is only resolved with WithPassingOnly(false).
+type Instance struct {
+	ID         string
+	Service    string
+	Node       string
+	Datacenter string
+	Tags       []string
+	Meta       map[string]string
+	Weight     int
+	Warning    bool
+}
+
+// InstanceFromAddress returns the Instance attached to an address by the
+// consul resolver.
+func InstanceFromAddress(addr resolver.Address) (Instance, bool) {
+	if addr.Attributes == nil {
+		return Instance{}, false
+	}
+	instance, ok := addr.Attributes.Value(instanceKey{}).(Instance)
+	return instance, ok
+}
+
+type consulResolver struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	cc         resolver.ClientConn
+	watch      *healthWatch
+	service    string
+	logf       func(format string, args ...interface{})
+	debugf     func(format string, args ...interface{})
+	resolveNow chan struct{}
+	done       chan struct{}
+	addresses  map[string]resolver.Address
+}
+
+func (r *consulResolver) run() {
+	defer close(r.done)
+
+	for {
+		entries, err := r.watch.next(r.ctx)
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+
+			r.logf("consul resolver: unable to resolve service, %v - %v", r.service, err)
+			r.cc.ReportError(err)
+
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-r.resolveNow:
+			case <-time.After(retryInterval):
+			}
+			continue
+		}
+
+		addresses := r.makeAddresses(entries)
+		r.debugf("consul resolver: resolved service, %v - %v", r.service, addresses)
+		r.cc.UpdateState(resolver.State{Addresses: addresses})
+	}
+}
+
+func (r *consulResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *consulResolver) Close() {
+	r.cancel()
+	<-r.done
+}
+
+type builder struct {
+	options   resolverOptions
+	newClient func(consulAddr string) HealthQueryAPI
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	input, err := parseEndpoint(target.Endpoint, b.options)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &consulResolver{
+		ctx:        ctx,
+		cancel:     cancel,
+		cc:         cc,
+		watch:      newHealthWatch(b.newClient(target.Authority), input, b.options),
+		service:    input.Service,
+		logf:       b.options.logf,
+		debugf:     b.options.debugf,
+		resolveNow: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go r.run()
+
+	return r, nil
+}
+
+func (b *builder) Scheme() string {
+	return Scheme
+}
+
+// NewBuilder returns a grpc resolver.Builder for consul:// targets.  The
+// authority of the target, when present, is the address of the consul agent
+// and the endpoint is the name of the service with optional tag and dc query
+// parameters.  A builder with default options is registered on init.
+func NewBuilder(opts ...ResolverOption) resolver.Builder {
+	return &builder{
+		options:   makeResolverOptions(opts...),
+		newClient: newHealthClient,
+	}
+}
+
+func newHealthClient(consulAddr string) HealthQueryAPI {
+	if consulAddr == "" {
+		return consulapi.NewHealth()
+	}
+	return consulapi.NewHealth(consulapi.WithConsulAddr(consulAddr))
+}
+
+// parseEndpoint converts the endpoint of a consul:// target,
+// my-service?tag=v2&dc=east, into a health query.  Tags and datacenter given
+// in the endpoint take precedence over those of the options.
+func parseEndpoint(endpoint string, options resolverOptions) (consulapi.HealthConnectRequest, error) {
+	service := endpoint
+	var rawQuery string
+	if i := strings.Index(endpoint, "?"); i >= 0 {
+		service, rawQuery = endpoint[:i], endpoint[i+1:]
+	}
+
+	if service == "" {
+		return consulapi.HealthConnectRequest{}, errMissingService
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return consulapi.HealthConnectRequest{}, err
+	}
+
+	input := options.request(service)
+	if tags := query["tag"]; len(tags) > 0 {
+		input.Tags = tags
+	}
+	if dc := query.Get("dc"); dc != "" {
+		input.Datacenter = dc
+	}
+
+	return input, nil
+}
+
+func newInstance(entry consulapi.HealthServiceEntry) Instance {
+	warning := entry.Warning()
+
+	weight := entry.Service.Weights.Passing
+	switch {
+	case entry.Service.Weights == consulapi.HealthServiceWeights{}:
+		weight = 1 // agents prior to consul 1.2.3 do not report weights
+	case warning:
+		weight = entry.Service.Weights.Warning
+	}
+
+	return Instance{
+		ID:         entry.Service.ID,
+		Service:    entry.Service.Service,
+		Node:       entry.Node.Node,
+		Datacenter: entry.Node.Datacenter,
+		Tags:       entry.Service.Tags,
+		Meta:       entry.Service.Meta,
+		Weight:     weight,
+		Warning:    warning,
+	}
+}
+
+// makeAddresses converts entries into resolver addresses.  Addresses whose
+// instance is unchanged are reused from the previous call as grpc balancers
+// compare addresses, attributes included, to decide which connections to
+// keep.
+func (r *consulResolver) makeAddresses(entries []consulapi.HealthServiceEntry) []resolver.Address {
+	instances := instancesByAddr(entries)
+
+	previous := r.addresses
+	r.addresses = make(map[string]resolver.Address, len(instances))
+
+	addresses := make([]resolver.Address, 0, len(instances))
+	for _, addr := range sortedAddrs(instances) {
+		instance := *instances[addr]
+
+		address, ok := previous[addr]
+		if existing, _ := InstanceFromAddress(address); !ok || !reflect.DeepEqual(existing, instance) {
+			address = resolver.Address{
+				Addr:       addr,
+				Attributes: attributes.New(instanceKey{}, instance),
+			}
+		}
+
+		r.addresses[addr] = address
+		addresses = append(addresses, address)
+	}
+
+	return addresses
+}
+
+// entryAddr returns the host:port of the entry; consul leaves the service
+// address blank when the service listens on the address of its node.
+func entryAddr(entry consulapi.HealthServiceEntry) string {
+	host := entry.Service.Address
+	if host == "" {
+		host = entry.Node.Address
+	}
+	return hostAndPort(host, entry.Service.Port)
+}
@@ -0,0 +1,172 @@
+package connect
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/savaki/consulapi"
+	"google.golang.org/grpc/resolver"
+)
+
+type ClientConn struct {
+	resolver.ClientConn
+	states chan resolver.State
+}
+
+func (c *ClientConn) UpdateState(state resolver.State) {
+	c.states <- state
+}
+
+func (c *ClientConn) ReportError(err error) {}
+
+func TestParseEndpoint(t *testing.T) {
+	got, err := parseEndpoint("my-service?tag=v2&tag=canary&dc=east", makeResolverOptions())
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	want := consulapi.HealthConnectRequest{
+		Service:    "my-service",
+		Passing:    true,
+		Tags:       []string{"v2", "canary"},
+		Datacenter: "east",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v; want %#v", got, want)
+	}
+
+	if _, err := parseEndpoint("?tag=v2", makeResolverOptions()); err != errMissingService {
+		t.Fatalf("got %v; want %v", err, errMissingService)
+	}
+}
+
+func TestParseEndpoint_Options(t *testing.T) {
+	options := makeResolverOptions(
+		WithTags("stable"),
+		WithDatacenter("west"),
+		WithFilter(`Service.Meta.version == "2"`),
+		WithPassingOnly(false),
+	)
+
+	got, err := parseEndpoint("my-service?dc=east", options)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	want := consulapi.HealthConnectRequest{
+		Service:    "my-service",
+		Tags:       []string{"stable"},
+		Filter:     `Service.Meta.version == "2"`,
+		Datacenter: "east",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	entry := consulapi.HealthServiceEntry{
+		Node: consulapi.HealthNode{
+			Node:       "n1",
+			Address:    "10.0.0.1",
+			Datacenter: "east",
+		},
+		Service: consulapi.HealthService{
+			ID:      "a1",
+			Service: "my-service",
+			Tags:    []string{"v2"},
+			Port:    8080,
+		},
+	}
+	m := &Mock{entries: [][]consulapi.HealthServiceEntry{{entry}}}
+
+	var consulAddr string
+	b := NewBuilder().(*builder)
+	b.newClient = func(addr string) HealthQueryAPI {
+		consulAddr = addr
+		return m
+	}
+
+	cc := &ClientConn{states: make(chan resolver.State, 1)}
+	target := resolver.Target{Scheme: Scheme, Authority: "agent:8500", Endpoint: "my-service?tag=v2&dc=east"}
+	r, err := b.Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer r.Close()
+
+	state := <-cc.states
+	if got, want := consulAddr, "agent:8500"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := len(state.Addresses), 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := state.Addresses[0].Addr, "10.0.0.1:8080"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	instance, ok := InstanceFromAddress(state.Addresses[0])
+	if !ok {
+		t.Fatalf("got false; want true")
+	}
+	want := Instance{
+		ID:         "a1",
+		Service:    "my-service",
+		Node:       "n1",
+		Datacenter: "east",
+		Tags:       []string{"v2"},
+		Weight:     1,
+	}
+	if !reflect.DeepEqual(instance, want) {
+		t.Fatalf("got %#v; want %#v", instance, want)
+	}
+
+	m.mutex.Lock()
+	input := m.inputs[0]
+	m.mutex.Unlock()
+	if got, want := input.Datacenter, "east"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestNewInstance_Weight(t *testing.T) {
+	weights := consulapi.HealthServiceWeights{Passing: 10, Warning: 2}
+	testCases := map[string]struct {
+		Entry   consulapi.HealthServiceEntry
+		Weight  int
+		Warning bool
+	}{
+		"no weights": {
+			Entry:  consulapi.HealthServiceEntry{},
+			Weight: 1,
+		},
+		"passing": {
+			Entry: consulapi.HealthServiceEntry{
+				Service: consulapi.HealthService{Weights: weights},
+				Checks:  []consulapi.HealthCheck{{Status: consulapi.StatusPass}},
+			},
+			Weight: 10,
+		},
+		"warning": {
+			Entry: consulapi.HealthServiceEntry{
+				Service: consulapi.HealthService{Weights: weights},
+				Checks:  []consulapi.HealthCheck{{Status: consulapi.StatusPass}, {Status: consulapi.StatusWarn}},
+			},
+			Weight:  2,
+			Warning: true,
+		},
+	}
+
+	for label, tc := range testCases {
+		t.Run(label, func(t *testing.T) {
+			instance := newInstance(tc.Entry)
+			if got, want := instance.Weight, tc.Weight; got != want {
+				t.Fatalf("got %v; want %v", got, want)
+			}
+			if got, want := instance.Warning, tc.Warning; got != want {
+				t.Fatalf("got %v; want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/savaki/consulapi"
+)
+
+const outputTimeout = "health check timed out"
+
+// HealthChecker reports the status of a service along with output that
+// describes it.  ctx is done when the check times out.
+type HealthChecker func(ctx context.Context) (consulapi.Status, string)
+
+// passing is the default checker of a service.
+func passing(context.Context) (consulapi.Status, string) {
+	return consulapi.StatusPass, "ok"
+}
+
+// errorChecker adapts a func() error; an error is critical.
+func errorChecker(fn func() error) HealthChecker {
+	return func(context.Context) (consulapi.Status, string) {
+		if err := fn(); err != nil {
+			return consulapi.StatusFail, err.Error()
+		}
+		return consulapi.StatusPass, "ok"
+	}
+}
+
+// timeoutGrace is how long a checker may take to return once its context is
+// done before it is reported as timed out, so checkers that honor ctx, such
+// as CompositeChecker, report their own output.
+const timeoutGrace = 50 * time.Millisecond
+
+type checkResult struct {
+	status consulapi.Status
+	output string
+}
+
+// checkRunner calls a checker with a context that times out after timeout.
+// At most one call is in flight: while a call that timed out has yet to
+// return, the check is reported as timed out without calling the checker
+// again, so a checker that ignores ctx cannot pile up goroutines.  A
+// checkRunner is used by one goroutine at a time.
+type checkRunner struct {
+	checker HealthChecker
+	timeout time.Duration
+	pending chan checkResult // the call that timed out, if any
+}
+
+// run calls the checker.  A checker that has not returned in time, or that
+// returns an unknown status, is reported as critical.
+func (r *checkRunner) run(ctx context.Context) (consulapi.Status, string) {
+	if r.pending != nil {
+		select {
+		case <-r.pending:
+			r.pending = nil // the previous call has since returned
+		default:
+			return consulapi.StatusFail, outputTimeout
+		}
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	results := make(chan checkResult, 1)
+	go func() {
+		status, output := r.checker(checkCtx)
+		results <- checkResult{status: status, output: output}
+	}()
+
+	select {
+	case result := <-results:
+		return normalize(result.status), result.output
+	case <-checkCtx.Done():
+	}
+
+	grace := time.NewTimer(timeoutGrace)
+	defer grace.Stop()
+
+	select {
+	case result := <-results:
+		return normalize(result.status), result.output
+	case <-ctx.Done():
+	case <-grace.C:
+	}
+
+	r.pending = results
+	return consulapi.StatusFail, outputTimeout
+}
+
+// severity orders statuses from passing to critical; unknown statuses are
+// treated as critical.
+func severity(status consulapi.Status) int {
+	switch status {
+	case consulapi.StatusPass:
+		return 0
+	case consulapi.StatusWarn:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// normalize reports statuses other than passing and warning, e.g. blank or
+// misspelt, as critical since the agent rejects them.
+func normalize(status consulapi.Status) consulapi.Status {
+	if severity(status) > severity(consulapi.StatusWarn) {
+		return consulapi.StatusFail
+	}
+	return status
+}
+
+// NamedCheck is a sub-check of a CompositeChecker.
+type NamedCheck struct {
+	Name    string
+	Checker HealthChecker
+}
+
+// CheckResult is the outcome of a NamedCheck as reported in the output of a
+// CompositeChecker.
+type CheckResult struct {
+	Name   string           `json:"name"`
+	Status consulapi.Status `json:"status"`
+	Output string           `json:"output,omitempty"`
+}
+
+// CompositeChecker returns a checker that runs the checks concurrently and
+// reports the most severe of their statuses; a status other than passing or
+// warning is critical.  When ctx is done before every check returns, the
+// checks still running are reported as critical and timed out.  The output
+// is a json array of CheckResult, in the order of checks, e.g.
+//
+//	[{"name":"database","status":"passing","output":"ok"},{"name":"cache","status":"warning","output":"slow"}]
+func CompositeChecker(checks ...NamedCheck) HealthChecker {
+	return func(ctx context.Context) (consulapi.Status, string) {
+		var (
+			mutex   sync.Mutex
+			results = make([]CheckResult, len(checks))
+			wg      sync.WaitGroup
+		)
+		for i, check := range checks {
+			results[i] = CheckResult{Name: check.Name, Status: consulapi.StatusFail, Output: outputTimeout}
+		}
+
+		wg.Add(len(checks))
+		for i, check := range checks {
+			go func(i int, check NamedCheck) {
+				defer wg.Done()
+				status, output := check.Checker(ctx)
+
+				mutex.Lock()
+				defer mutex.Unlock()
+				results[i] = CheckResult{Name: check.Name, Status: normalize(status), Output: output}
+			}(i, check)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+
+		mutex.Lock()
+		snapshot := append([]CheckResult(nil), results...)
+		mutex.Unlock()
+
+		status := consulapi.StatusPass
+		for _, result := range snapshot {
+			if severity(result.Status) > severity(status) {
+				status = result.Status
+			}
+		}
+
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return consulapi.StatusFail, err.Error()
+		}
+		return status, string(data)
+	}
+}
+
+// Check is an additional ttl check of a service, registered with WithCheck,
+// so operators can see which dependency of a service is failing.
+type Check struct {
+	// ID defaults to service:<service id>:<name>
+	ID    string
+	Name  string
+	Notes string
+	// Interval between updates of the check; defaults to the health check
+	// interval of the service
+	Interval time.Duration
+	// Timeout bounds each call of Checker; defaults to Interval
+	Timeout time.Duration
+	// TTL of the check; defaults to three times Interval
+	TTL     time.Duration
+	Checker HealthChecker
+}
@@ -0,0 +1,243 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/savaki/consulapi"
+)
+
+func fixed(status consulapi.Status, output string) HealthChecker {
+	return func(context.Context) (consulapi.Status, string) {
+		return status, output
+	}
+}
+
+func TestCheckRunner(t *testing.T) {
+	runner := &checkRunner{checker: fixed(consulapi.StatusWarn, "slow"), timeout: time.Second}
+	status, output := runner.run(context.Background())
+	if got, want := status, consulapi.StatusWarn; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := output, "slow"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestCheckRunner_Unknown(t *testing.T) {
+	for _, status := range []consulapi.Status{"", "passed"} {
+		runner := &checkRunner{checker: fixed(status, "ok"), timeout: time.Second}
+		if got, _ := runner.run(context.Background()); got != consulapi.StatusFail {
+			t.Fatalf("got %v; want %v", got, consulapi.StatusFail)
+		}
+	}
+}
+
+func TestCheckRunner_Timeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	// the checker ignores ctx; run still returns
+	checker := func(ctx context.Context) (consulapi.Status, string) {
+		<-block
+		return consulapi.StatusPass, "ok"
+	}
+
+	runner := &checkRunner{checker: checker, timeout: 10 * time.Millisecond}
+	status, output := runner.run(context.Background())
+	if got, want := status, consulapi.StatusFail; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := output, outputTimeout; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestCheckRunner_Hung(t *testing.T) {
+	var (
+		block = make(chan struct{})
+		calls int32
+	)
+
+	// like the checkers of WithHealthCheckFunc, the checker cannot see ctx
+	checker := errorChecker(func() error {
+		atomic.AddInt32(&calls, 1)
+		<-block
+		return nil
+	})
+
+	runner := &checkRunner{checker: checker, timeout: time.Millisecond}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		if status, output := runner.run(context.Background()); status != consulapi.StatusFail || output != outputTimeout {
+			t.Fatalf("got %v, %v; want %v, %v", status, output, consulapi.StatusFail, outputTimeout)
+		}
+	}
+	if got, want := runtime.NumGoroutine(), before+1; got > want {
+		t.Fatalf("got %v goroutines; want at most %v", got, want)
+	}
+	if got, want := atomic.LoadInt32(&calls), int32(1); got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	// once the hung call returns, the checker is called again
+	close(block)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if status, _ := runner.run(context.Background()); status == consulapi.StatusPass {
+			return
+		}
+	}
+	t.Fatalf("got critical; want %v", consulapi.StatusPass)
+}
+
+func TestErrorChecker(t *testing.T) {
+	status, output := errorChecker(func() error { return errors.New("boom") })(context.Background())
+	if status != consulapi.StatusFail || output != "boom" {
+		t.Fatalf("got %v, %v; want %v, boom", status, output, consulapi.StatusFail)
+	}
+}
+
+func TestCompositeChecker(t *testing.T) {
+	testCases := map[string]struct {
+		Checks []NamedCheck
+		Want   consulapi.Status
+	}{
+		"empty": {
+			Want: consulapi.StatusPass,
+		},
+		"passing": {
+			Checks: []NamedCheck{
+				{Name: "database", Checker: fixed(consulapi.StatusPass, "ok")},
+				{Name: "cache", Checker: fixed(consulapi.StatusPass, "ok")},
+			},
+			Want: consulapi.StatusPass,
+		},
+		"warning": {
+			Checks: []NamedCheck{
+				{Name: "database", Checker: fixed(consulapi.StatusPass, "ok")},
+				{Name: "cache", Checker: fixed(consulapi.StatusWarn, "slow")},
+			},
+			Want: consulapi.StatusWarn,
+		},
+		"critical": {
+			Checks: []NamedCheck{
+				{Name: "database", Checker: fixed(consulapi.StatusFail, "down")},
+				{Name: "cache", Checker: fixed(consulapi.StatusWarn, "slow")},
+			},
+			Want: consulapi.StatusFail,
+		},
+		"unknown": {
+			Checks: []NamedCheck{
+				{Name: "database", Checker: fixed(consulapi.StatusPass, "ok")},
+				{Name: "cache", Checker: fixed("maintenance", "")},
+			},
+			Want: consulapi.StatusFail,
+		},
+		"blank": {
+			Checks: []NamedCheck{
+				{Name: "database", Checker: fixed("", "")},
+			},
+			Want: consulapi.StatusFail,
+		},
+	}
+
+	for label, tc := range testCases {
+		t.Run(label, func(t *testing.T) {
+			status, output := CompositeChecker(tc.Checks...)(context.Background())
+			if got, want := status, tc.Want; got != want {
+				t.Fatalf("got %v; want %v", got, want)
+			}
+
+			var results []CheckResult
+			if err := json.Unmarshal([]byte(output), &results); err != nil {
+				t.Fatalf("got %v; want nil", err)
+			}
+			if got, want := len(results), len(tc.Checks); got != want {
+				t.Fatalf("got %v; want %v", got, want)
+			}
+			for i, check := range tc.Checks {
+				if got, want := results[i].Name, check.Name; got != want {
+					t.Fatalf("got %v; want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompositeChecker_Output(t *testing.T) {
+	_, output := CompositeChecker(
+		NamedCheck{Name: "database", Checker: fixed(consulapi.StatusPass, "ok")},
+		NamedCheck{Name: "cache", Checker: fixed(consulapi.StatusWarn, "slow")},
+	)(context.Background())
+
+	var results []CheckResult
+	if err := json.Unmarshal([]byte(output), &results); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	want := []CheckResult{
+		{Name: "database", Status: consulapi.StatusPass, Output: "ok"},
+		{Name: "cache", Status: consulapi.StatusWarn, Output: "slow"},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Fatalf("got %v; want %v", results, want)
+	}
+}
+
+func TestCompositeChecker_OutputUnknown(t *testing.T) {
+	_, output := CompositeChecker(
+		NamedCheck{Name: "database", Checker: fixed("maintenance", "")},
+	)(context.Background())
+
+	var results []CheckResult
+	if err := json.Unmarshal([]byte(output), &results); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := results, []CheckResult{{Name: "database", Status: consulapi.StatusFail}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestCompositeChecker_Timeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	hung := func(context.Context) (consulapi.Status, string) {
+		<-block
+		return consulapi.StatusPass, "ok"
+	}
+
+	runner := &checkRunner{
+		checker: CompositeChecker(
+			NamedCheck{Name: "database", Checker: fixed(consulapi.StatusPass, "ok")},
+			NamedCheck{Name: "cache", Checker: hung},
+		),
+		timeout: 10 * time.Millisecond,
+	}
+
+	// the composite reports which sub-check timed out rather than timing
+	// out as a whole
+	status, output := runner.run(context.Background())
+	if got, want := status, consulapi.StatusFail; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	var results []CheckResult
+	if err := json.Unmarshal([]byte(output), &results); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	want := []CheckResult{
+		{Name: "database", Status: consulapi.StatusPass, Output: "ok"},
+		{Name: "cache", Status: consulapi.StatusFail, Output: outputTimeout},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Fatalf("got %v; want %v", results, want)
+	}
+}
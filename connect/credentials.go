@@ -0,0 +1,165 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/savaki/consulapi/connect/spiffe"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// AuthType is the auth type reported by the AuthInfo of connect credentials.
+const AuthType = "consul-connect"
+
+// AuthInfo describes the peer of a grpc connection secured by connect
+// credentials.  Interceptors may retrieve it with AuthInfoFromContext.
+type AuthInfo struct {
+	credentials.CommonAuthInfo
+
+	// State is the state of the tls connection
+	State tls.ConnectionState
+
+	TrustDomain string
+	Namespace   string
+	Datacenter  string
+	// Service is the connect service identity of the peer
+	Service string
+}
+
+// AuthType implements credentials.AuthInfo
+func (a AuthInfo) AuthType() string {
+	return AuthType
+}
+
+type authInfoKey struct{}
+
+// AuthInfoFromContext returns the AuthInfo of the peer of a grpc request
+// served with ServerCredentials or of an http request served by ServeHTTP.
+func AuthInfoFromContext(ctx context.Context) (AuthInfo, bool) {
+	if info, ok := ctx.Value(authInfoKey{}).(AuthInfo); ok {
+		return info, true
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return AuthInfo{}, false
+	}
+	info, ok := p.AuthInfo.(AuthInfo)
+	return info, ok
+}
+
+// newAuthInfo returns the AuthInfo of the peer of a tls connection.
+func newAuthInfo(state tls.ConnectionState) (AuthInfo, error) {
+	id, err := spiffe.FromConnectionState(state)
+	if err != nil {
+		return AuthInfo{}, err
+	}
+
+	return AuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+		State:          state,
+		TrustDomain:    id.TrustDomain,
+		Namespace:      id.Namespace,
+		Datacenter:     id.Datacenter,
+		Service:        id.Service,
+	}, nil
+}
+
+type connectCredentials struct {
+	source     *TLSSource
+	authorizer *Authorizer // set only for server credentials
+	target     string      // set only for client credentials
+	serverName string
+}
+
+func (c *connectCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	config := c.source.ClientTLSConfig(c.target)
+	config.NextProtos = []string{"h2"}
+	config.ServerName = c.serverName
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(authority); err == nil {
+			config.ServerName = host
+		} else {
+			config.ServerName = authority
+		}
+	}
+
+	conn := tls.Client(rawConn, config)
+	if err := handshakeContext(ctx, conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	info, err := newAuthInfo(conn.ConnectionState())
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, info, nil
+}
+
+func (c *connectCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	config := c.source.ServerTLSConfig()
+	config.NextProtos = []string{"h2"}
+	config.VerifyConnection = c.authorizer.VerifyConnection
+
+	conn := tls.Server(rawConn, config)
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	info, err := newAuthInfo(conn.ConnectionState())
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, info, nil
+}
+
+func (c *connectCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: "tls",
+		ServerName:       c.serverName,
+	}
+}
+
+func (c *connectCredentials) Clone() credentials.TransportCredentials {
+	clone := *c
+	return &clone
+}
+
+func (c *connectCredentials) OverrideServerName(serverName string) error {
+	c.serverName = serverName
+	return nil
+}
+
+// ServerCredentials returns grpc transport credentials that serve the connect
+// certificates of source and authorize each client against the intentions
+// of the service of source during the handshake.
+//
+//	server := grpc.NewServer(grpc.Creds(connect.ServerCredentials(agent, source)))
+func ServerCredentials(agent AuthorizeAPI, source *TLSSource, opts ...AuthorizerOption) credentials.TransportCredentials {
+	return &connectCredentials{
+		source:     source,
+		authorizer: NewAuthorizer(agent, source.Service(), opts...),
+	}
+}
+
+// ClientCredentials returns grpc transport credentials that present the
+// connect certificates of source and require the server to identify itself
+// as target.
+//
+//	conn, err := grpc.Dial("consul://localhost:8500/db",
+//		grpc.WithTransportCredentials(connect.ClientCredentials(source, "db")),
+//	)
+func ClientCredentials(source *TLSSource, target string) credentials.TransportCredentials {
+	return &connectCredentials{
+		source: source,
+		target: target,
+	}
+}
@@ -0,0 +1,126 @@
+package connect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// serveHealth serves the grpc health service from server on a loopback port.
+func serveHealth(t *testing.T, server *grpc.Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return listener.Addr().String()
+}
+
+func checkHealth(addr string, opts ...grpc.DialOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, addr, append(opts, grpc.WithBlock())...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	return err
+}
+
+func TestCredentials(t *testing.T) {
+	var (
+		ca     = NewTestCA(t, testTrustDomain)
+		server = newTestTLSSource(t, ca, "db")
+		client = newTestTLSSource(t, ca, "web")
+		m      = &AuthorizeMock{allowed: map[string]bool{"web": true}}
+		infos  = make(chan AuthInfo, 1)
+	)
+
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		authInfo, ok := AuthInfoFromContext(ctx)
+		if !ok {
+			t.Errorf("got false; want true")
+		}
+		infos <- authInfo
+		return handler(ctx, req)
+	}
+
+	addr := serveHealth(t, grpc.NewServer(
+		grpc.Creds(ServerCredentials(m, server)),
+		grpc.UnaryInterceptor(interceptor),
+	))
+
+	if err := checkHealth(addr, grpc.WithTransportCredentials(ClientCredentials(client, "db"))); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	info := <-infos
+	if got, want := info.Service, "web"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := info.TrustDomain, testTrustDomain; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := info.AuthType(), AuthType; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestCredentials_Unauthorized(t *testing.T) {
+	var (
+		ca     = NewTestCA(t, testTrustDomain)
+		server = newTestTLSSource(t, ca, "db")
+		client = newTestTLSSource(t, ca, "evil")
+		m      = &AuthorizeMock{allowed: map[string]bool{"web": true}}
+	)
+
+	addr := serveHealth(t, grpc.NewServer(grpc.Creds(ServerCredentials(m, server))))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(ClientCredentials(client, "db")))
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer conn.Close()
+
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err == nil {
+		t.Fatalf("got nil; want error")
+	}
+}
+
+func TestCredentials_WrongTarget(t *testing.T) {
+	var (
+		ca     = NewTestCA(t, testTrustDomain)
+		server = newTestTLSSource(t, ca, "cache")
+		client = newTestTLSSource(t, ca, "web")
+		m      = &AuthorizeMock{allowed: map[string]bool{"web": true}}
+	)
+
+	addr := serveHealth(t, grpc.NewServer(grpc.Creds(ServerCredentials(m, server))))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := grpc.DialContext(ctx, addr,
+		grpc.WithTransportCredentials(ClientCredentials(client, "db")),
+		grpc.WithBlock(),
+	)
+	if err == nil {
+		t.Fatalf("got nil; want error")
+	}
+}
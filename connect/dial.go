@@ -0,0 +1,82 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+
+	"github.com/savaki/consulapi"
+)
+
+var errNoInstances = errors.New("connect: no healthy instances of service")
+
+// handshakeContext performs the tls handshake of conn, abandoning it when ctx
+// is done.
+func handshakeContext(ctx context.Context, conn *tls.Conn) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- conn.Handshake()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		conn.Close()
+		return ctx.Err()
+	}
+}
+
+// Dial connects to a healthy instance of target using the certificates of
+// source.  Instances are found with a connect health query built from opts
+// and tried in turn, nearest first when WithNearest is given and in random
+// order otherwise, until one completes a handshake in which it identifies
+// itself as target.
+func Dial(ctx context.Context, health HealthQueryAPI, source *TLSSource, target string, opts ...ResolverOption) (net.Conn, error) {
+	options := makeResolverOptions(opts...)
+	return dial(ctx, health, source, options.request(target), options)
+}
+
+func dial(ctx context.Context, health HealthQueryAPI, source *TLSSource, input consulapi.HealthConnectRequest, options resolverOptions) (net.Conn, error) {
+	target := input.Service
+
+	watch := newHealthWatch(health, input, options)
+	watch.waitTime = 0 // a single non-blocking query
+
+	entries, err := watch.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errNoInstances
+	}
+	if options.nearest == 0 {
+		rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	}
+
+	var dialer net.Dialer
+	for _, entry := range entries {
+		addr := entryAddr(entry)
+
+		raw, e := dialer.DialContext(ctx, "tcp", addr)
+		if e != nil {
+			options.logf("connect: unable to dial %v at %v - %v", target, addr, e)
+			err = e
+			continue
+		}
+
+		conn := tls.Client(raw, source.ClientTLSConfig(target))
+		if e := handshakeContext(ctx, conn); e != nil {
+			options.logf("connect: tls handshake with %v at %v failed - %v", target, addr, e)
+			conn.Close()
+			err = e
+			continue
+		}
+
+		return conn, nil
+	}
+
+	return nil, err
+}
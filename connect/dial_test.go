@@ -0,0 +1,163 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/savaki/consulapi"
+	"github.com/savaki/consulapi/connect/spiffe"
+)
+
+// serveEcho accepts connections from listener and echoes back the name of
+// the connect service of each client.
+func serveEcho(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			id, _ := spiffe.FromConnectionState(conn.(*tls.Conn).ConnectionState())
+			io.WriteString(conn, id.Service)
+		}()
+	}
+}
+
+// healthAt returns a HealthQueryAPI that reports a single instance at addr.
+func healthAt(t *testing.T, addr string) HealthFunc {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	return func(ctx context.Context, input consulapi.HealthConnectRequest) (consulapi.HealthConnectResponse, error) {
+		return consulapi.HealthConnectResponse{
+			Entries: []consulapi.HealthServiceEntry{
+				{Service: consulapi.HealthService{ID: "db-1", Service: input.Service, Address: host, Port: port}},
+			},
+		}, nil
+	}
+}
+
+func TestDial(t *testing.T) {
+	var (
+		ca     = NewTestCA(t, testTrustDomain)
+		server = newTestTLSSource(t, ca, "db")
+		client = newTestTLSSource(t, ca, "web")
+		m      = &AuthorizeMock{allowed: map[string]bool{"web": true}}
+	)
+
+	listener, err := Listen(server, NewAuthorizer(m, "db"), "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer listener.Close()
+	go serveEcho(listener)
+
+	conn, err := Dial(context.Background(), healthAt(t, listener.Addr().String()), client, "db")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer conn.Close()
+
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := string(data), "web"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestDial_Unauthorized(t *testing.T) {
+	var (
+		ca     = NewTestCA(t, testTrustDomain)
+		server = newTestTLSSource(t, ca, "db")
+		client = newTestTLSSource(t, ca, "evil")
+		m      = &AuthorizeMock{allowed: map[string]bool{"web": true}}
+	)
+
+	listener, err := Listen(server, NewAuthorizer(m, "db"), "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer listener.Close()
+	go serveEcho(listener)
+
+	conn, err := Dial(context.Background(), healthAt(t, listener.Addr().String()), client, "db")
+	if err != nil {
+		return // rejected during the handshake
+	}
+	defer conn.Close()
+
+	// tls 1.3 clients complete the handshake before the server has verified
+	// the client certificate; the rejection surfaces on the first read
+	if data, err := ioutil.ReadAll(conn); err == nil || len(data) > 0 {
+		t.Fatalf("got %q, %v; want error", data, err)
+	}
+}
+
+func TestDial_WrongTarget(t *testing.T) {
+	var (
+		ca     = NewTestCA(t, testTrustDomain)
+		server = newTestTLSSource(t, ca, "cache")
+		client = newTestTLSSource(t, ca, "web")
+	)
+
+	listener, err := Listen(server, nil, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer listener.Close()
+	go serveEcho(listener)
+
+	_, err = Dial(context.Background(), healthAt(t, listener.Addr().String()), client, "db")
+	if err == nil {
+		t.Fatalf("got nil; want error")
+	}
+}
+
+func TestDial_NoInstances(t *testing.T) {
+	ca := NewTestCA(t, testTrustDomain)
+	client := newTestTLSSource(t, ca, "web")
+
+	fn := HealthFunc(func(ctx context.Context, input consulapi.HealthConnectRequest) (consulapi.HealthConnectResponse, error) {
+		if input.WaitIndex != 0 {
+			t.Errorf("got %v; want 0", input.WaitIndex)
+		}
+		return consulapi.HealthConnectResponse{}, nil
+	})
+
+	if _, err := Dial(context.Background(), fn, client, "db"); err != errNoInstances {
+		t.Fatalf("got %v; want %v", err, errNoInstances)
+	}
+}
+
+func TestListener_Close(t *testing.T) {
+	source := newTestTLSSource(t, NewTestCA(t, testTrustDomain), "db")
+
+	listener, err := Listen(source, nil, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		errs <- err
+	}()
+
+	if err := listener.Close(); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if err := <-errs; err == nil {
+		t.Fatalf("got nil; want error")
+	}
+}
@@ -0,0 +1,84 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/savaki/consulapi"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// GRPCHealthChecker returns a checker that reports the serving status of
+// service, "" for the server as a whole, from a grpc health server such as
+// the one provided by google.golang.org/grpc/health.  SERVING is passing;
+// any other status, or an unknown service, is critical.
+func GRPCHealthChecker(server grpc_health_v1.HealthServer, service string) HealthChecker {
+	return func(ctx context.Context) (consulapi.Status, string) {
+		resp, err := server.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+		if err != nil {
+			return consulapi.StatusFail, err.Error()
+		}
+
+		status := resp.GetStatus()
+		if status == grpc_health_v1.HealthCheckResponse_SERVING {
+			return consulapi.StatusPass, status.String()
+		}
+		return consulapi.StatusFail, status.String()
+	}
+}
+
+var errGRPCCheckNative = errors.New("connect: WithGRPCCheck requires WithSidecar")
+
+// WithGRPCHealthServer derives the status of the primary check of the service
+// from the serving status of service in server.  See GRPCHealthChecker.
+func WithGRPCHealthServer(server grpc_health_v1.HealthServer, service string) ServiceOption {
+	return WithHealthChecker(GRPCHealthChecker(server, service))
+}
+
+// WithGRPCCheck registers a native consul grpc check that has the agent call
+// the grpc health service of the service at its address and port every
+// interval, or the health check interval when interval is 0.  grpcService,
+// when not blank, is the service name passed in the health check request.
+//
+// The agent calls the service in plaintext and cannot present a connect
+// certificate, so the check is only available with WithSidecar, where the
+// service itself does not terminate connect tls.  NewService returns an
+// error when it is used without WithSidecar.
+func WithGRPCCheck(interval time.Duration, grpcService string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.grpcCheck = &grpcCheck{
+			interval: interval,
+			service:  grpcService,
+		}
+	}
+}
+
+type grpcCheck struct {
+	interval time.Duration
+	service  string
+}
+
+// registration returns the native check of the service with the given ID
+// listening at address:port.  The agent is assumed to share the host of the
+// service when address is blank.
+func (c grpcCheck) registration(serviceID, address string, port int) *consulapi.AgentServiceCheck {
+	if address == "" {
+		address = "127.0.0.1"
+	}
+
+	target := net.JoinHostPort(address, strconv.Itoa(port))
+	if c.service != "" {
+		target += "/" + c.service
+	}
+
+	return &consulapi.AgentServiceCheck{
+		CheckID:  "service:" + serviceID + ":grpc",
+		Name:     fmt.Sprintf("gRPC health of %v", target),
+		GRPC:     target,
+		Interval: makeTTL(c.interval),
+	}
+}
@@ -0,0 +1,103 @@
+package connect
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/savaki/consulapi"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGRPCHealthChecker(t *testing.T) {
+	server := health.NewServer()
+	server.SetServingStatus("orders", grpc_health_v1.HealthCheckResponse_SERVING)
+
+	testCases := map[string]struct {
+		Service string
+		Set     grpc_health_v1.HealthCheckResponse_ServingStatus
+		Want    consulapi.Status
+	}{
+		"serving":     {Service: "orders", Set: grpc_health_v1.HealthCheckResponse_SERVING, Want: consulapi.StatusPass},
+		"not serving": {Service: "orders", Set: grpc_health_v1.HealthCheckResponse_NOT_SERVING, Want: consulapi.StatusFail},
+		"unknown":     {Service: "missing", Want: consulapi.StatusFail},
+	}
+
+	for label, tc := range testCases {
+		t.Run(label, func(t *testing.T) {
+			if tc.Service == "orders" {
+				server.SetServingStatus(tc.Service, tc.Set)
+			}
+
+			status, output := GRPCHealthChecker(server, tc.Service)(context.Background())
+			if got, want := status, tc.Want; got != want {
+				t.Fatalf("got %v (%v); want %v", got, output, want)
+			}
+		})
+	}
+}
+
+func TestService_GRPC(t *testing.T) {
+	server := health.NewServer()
+	server.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	agent := &AgentMock{}
+	service, err := NewService(agent, "web", 8080,
+		WithServiceID("web-1"),
+		WithAddress("10.0.0.1"),
+		WithHealthCheckInterval(10*time.Millisecond),
+		WithGRPCHealthServer(server, ""),
+		WithGRPCCheck(10*time.Second, "orders"),
+		WithSidecar(0),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer service.Close()
+
+	registration := waitForRegistrations(t, agent, 1)[0]
+	want := &consulapi.AgentServiceCheck{
+		CheckID:  "service:web-1:grpc",
+		Name:     "gRPC health of 10.0.0.1:8080/orders",
+		GRPC:     "10.0.0.1:8080/orders",
+		Interval: "10s",
+	}
+	if got := registration.Checks; len(got) != 1 || *got[0] != *want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if status, _ := service.Status(); status != "" {
+			break
+		}
+	}
+	if status, output := service.Status(); status != consulapi.StatusFail || output != "NOT_SERVING" {
+		t.Fatalf("got %v, %v; want %v, NOT_SERVING", status, output, consulapi.StatusFail)
+	}
+}
+
+func TestService_GRPCCheckNative(t *testing.T) {
+	_, err := NewService(&AgentMock{}, "web", 8080, WithGRPCCheck(10*time.Second, ""))
+	if err != errGRPCCheckNative {
+		t.Fatalf("got %v; want %v", err, errGRPCCheckNative)
+	}
+}
+
+func TestService_GRPCCheckInterval(t *testing.T) {
+	agent := &AgentMock{}
+	service, err := NewService(agent, "web", 8080,
+		WithHealthCheckInterval(5*time.Second),
+		WithGRPCCheck(0, ""),
+		WithSidecar(0),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer service.Close()
+
+	registration := waitForRegistrations(t, agent, 1)[0]
+	if got, want := registration.Checks[0].Interval, "5s"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
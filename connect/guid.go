@@ -0,0 +1,25 @@
+package connect
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// guid returns a random, RFC 4122 version 4, uuid as used by consul for
+// service and check IDs.  It is safe for concurrent use.
+func guid() (string, error) {
+	return newUUID(rand.Reader)
+}
+
+func newUUID(r io.Reader) (string, error) {
+	var data [16]byte
+	if _, err := io.ReadFull(r, data[:]); err != nil {
+		return "", fmt.Errorf("connect: unable to generate uuid: %v", err)
+	}
+
+	data[6] = data[6]&0x0f | 0x40 // version 4
+	data[8] = data[8]&0x3f | 0x80 // variant 10
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", data[0:4], data[4:6], data[6:8], data[8:10], data[10:16]), nil
+}
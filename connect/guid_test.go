@@ -0,0 +1,56 @@
+package connect
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+var reUUID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestGUID(t *testing.T) {
+	const n = 100
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		seen  = map[string]bool{}
+	)
+
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+
+			id, err := guid()
+			if err != nil {
+				t.Errorf("got %v; want nil", err)
+				return
+			}
+			if !reUUID.MatchString(id) {
+				t.Errorf("got %v; want uuid v4", id)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if seen[id] {
+				t.Errorf("got duplicate %v", id)
+			}
+			seen[id] = true
+		}()
+	}
+	wg.Wait()
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("entropy exhausted")
+}
+
+func TestNewUUID_Error(t *testing.T) {
+	if _, err := newUUID(errReader{}); err == nil {
+		t.Fatalf("got nil; want error")
+	}
+}
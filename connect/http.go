@@ -0,0 +1,140 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/savaki/consulapi"
+)
+
+// shutdownTimeout bounds the time ServeHTTP waits for in flight requests
+// once its context is done.
+const shutdownTimeout = 10 * time.Second
+
+var errNotConnectHost = errors.New("connect: host is not of the form [tag.]service.service[.dc].consul")
+
+// ConnectAgentAPI is the subset of the consul agent api needed to register
+// and serve a Connect Native service.
+type ConnectAgentAPI interface {
+	AgentAPI
+	AuthorizeAPI
+	CAAPI
+}
+
+// parseConnectHost parses a consul dns style host name,
+// [tag.]service.service[.dc].consul, into a health query.  The tag and
+// datacenter, when present, take precedence over those of the options.
+func parseConnectHost(host string, options resolverOptions) (consulapi.HealthConnectRequest, error) {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(host), "."), ".")
+	if len(labels) < 3 || labels[len(labels)-1] != "consul" {
+		return consulapi.HealthConnectRequest{}, errNotConnectHost
+	}
+	labels = labels[:len(labels)-1]
+
+	var dc string
+	if labels[len(labels)-1] != "service" {
+		dc, labels = labels[len(labels)-1], labels[:len(labels)-1]
+	}
+	if len(labels) < 2 || len(labels) > 3 || labels[len(labels)-1] != "service" {
+		return consulapi.HealthConnectRequest{}, errNotConnectHost
+	}
+
+	input := options.request(labels[len(labels)-2])
+	if len(labels) == 3 {
+		input.Tags = []string{labels[0]}
+	}
+	if dc != "" {
+		input.Datacenter = dc
+	}
+
+	return input, nil
+}
+
+// HTTPClient returns an http client that connects to hosts named as in
+// consul dns, http://my-service.service.consul/path, over connect tls using
+// the certificates of source.  Each new connection is made to a healthy
+// instance of the service chosen as by Dial.  Requests to other hosts fail.
+func HTTPClient(health HealthQueryAPI, source *TLSSource, opts ...ResolverOption) *http.Client {
+	options := makeResolverOptions(opts...)
+
+	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		input, err := parseConnectHost(host, options)
+		if err != nil {
+			return nil, err
+		}
+
+		return dial(ctx, health, source, input, options)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			// connections are secured with connect tls regardless of the
+			// scheme of the request
+			DialContext:         dialContext,
+			DialTLSContext:      dialContext,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// ServeHTTP registers service with the consul agent as a Connect Native
+// service listening on port and serves handler over connect tls until ctx
+// is done.  Clients must be authorized by intentions; the identity of the
+// client of each request is available via AuthInfoFromContext.
+func ServeHTTP(ctx context.Context, agent ConnectAgentAPI, service string, port int, handler http.Handler, opts ...ServiceOption) error {
+	source, err := NewTLSSource(ctx, agent, service)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	listener, err := Listen(source, NewAuthorizer(agent, service), fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	svc, err := NewService(agent, service, port, opts...)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+
+	server := &http.Server{
+		Handler: handler,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			// connections from Listen have completed the tls handshake
+			info, err := newAuthInfo(conn.(*tls.Conn).ConnectionState())
+			if err != nil {
+				return ctx
+			}
+			return context.WithValue(ctx, authInfoKey{}, info)
+		},
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+}
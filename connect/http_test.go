@@ -0,0 +1,143 @@
+package connect
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/savaki/consulapi"
+)
+
+func TestParseConnectHost(t *testing.T) {
+	options := makeResolverOptions(WithTags("v1"))
+
+	testCases := map[string]struct {
+		Host       string
+		Service    string
+		Tags       []string
+		Datacenter string
+		Err        error
+	}{
+		"service": {Host: "web.service.consul", Service: "web", Tags: []string{"v1"}},
+		"tag":     {Host: "v2.web.service.consul", Service: "web", Tags: []string{"v2"}},
+		"dc":      {Host: "v2.web.service.east.consul.", Service: "web", Tags: []string{"v2"}, Datacenter: "east"},
+		"node":    {Host: "web.node.consul", Err: errNotConnectHost},
+		"other":   {Host: "example.com", Err: errNotConnectHost},
+		"short":   {Host: "service.consul", Err: errNotConnectHost},
+	}
+
+	for label, tc := range testCases {
+		t.Run(label, func(t *testing.T) {
+			input, err := parseConnectHost(tc.Host, options)
+			if err != tc.Err {
+				t.Fatalf("got %v; want %v", err, tc.Err)
+			}
+			if err != nil {
+				return
+			}
+			if got, want := input.Service, tc.Service; got != want {
+				t.Fatalf("got %v; want %v", got, want)
+			}
+			if got, want := input.Tags, tc.Tags; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v; want %v", got, want)
+			}
+			if got, want := input.Datacenter, tc.Datacenter; got != want {
+				t.Fatalf("got %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestServeHTTP(t *testing.T) {
+	var (
+		ca     = NewTestCA(t, testTrustDomain)
+		client = newTestTLSSource(t, ca, "web")
+		port   = freePort(t)
+		agent  = &AgentMock{
+			CAMock:        NewCAMock(ca),
+			AuthorizeMock: &AuthorizeMock{allowed: map[string]bool{"web": true}},
+		}
+	)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := AuthInfoFromContext(req.Context())
+		if !ok {
+			http.Error(w, "no auth info", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, info.Service)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ServeHTTP(ctx, agent, "db", port, handler)
+	}()
+
+	health := healthAt(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	httpClient := HTTPClient(health, client)
+
+	var resp *http.Response
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if resp, err = httpClient.Get("http://db.service.consul/"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := string(data), "web"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if got, want := len(agent.registrations), 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := agent.registrations[0].Name, "db"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := agent.deregistered, []string{agent.registrations[0].ID}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestHTTPClient_NotConnectHost(t *testing.T) {
+	client := newTestTLSSource(t, NewTestCA(t, testTrustDomain), "web")
+	health := HealthFunc(func(ctx context.Context, input consulapi.HealthConnectRequest) (consulapi.HealthConnectResponse, error) {
+		t.Errorf("unexpected health query")
+		return consulapi.HealthConnectResponse{}, nil
+	})
+
+	if _, err := HTTPClient(health, client).Get("http://example.com/"); err == nil {
+		t.Fatalf("got nil; want error")
+	}
+}
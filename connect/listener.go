@@ -0,0 +1,115 @@
+package connect
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var errListenerClosed = errors.New("connect: listener closed")
+
+// handshakeTimeout bounds the tls handshake of inbound connections.
+const handshakeTimeout = 10 * time.Second
+
+// listener completes the tls handshake of each inbound connection in the
+// background so slow or unauthorized clients do not hold up Accept.
+type listener struct {
+	net.Listener
+	config *tls.Config
+	logf   func(format string, args ...interface{})
+
+	conns chan net.Conn
+	err   error // set before conns is closed
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *listener) serve() {
+	defer close(l.conns)
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				l.logf("connect: temporary error accepting connection - %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			return
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+func (l *listener) handshake(raw net.Conn) {
+	conn := tls.Server(raw, l.config)
+
+	raw.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		l.logf("connect: tls handshake with %v failed - %v", raw.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	raw.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection that has completed the tls handshake.
+// The returned connections are of type *tls.Conn.
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn, ok := <-l.conns:
+		if !ok {
+			return nil, l.err
+		}
+		return conn, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *listener) Close() error {
+	err := errListenerClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// Listen announces on the local network address and returns a listener that
+// terminates connect tls with the certificates of source.  Clients must
+// present a certificate issued by the connect CA and, when authorizer is not
+// nil, be authorized by intentions.
+func Listen(source *TLSSource, authorizer *Authorizer, addr string) (net.Listener, error) {
+	inner, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := source.ServerTLSConfig()
+	if authorizer != nil {
+		config.VerifyConnection = authorizer.VerifyConnection
+	}
+
+	l := &listener{
+		Listener: inner,
+		config:   config,
+		logf:     source.options.logf,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	go l.serve()
+
+	return l, nil
+}
@@ -1,16 +1,50 @@
 package connect
 
 import (
+	"context"
 	"time"
+
+	"github.com/savaki/consulapi"
+)
+
+const (
+	defaultWaitTime    = 5 * time.Minute
+	defaultMinInterval = time.Second
 )
 
 type resolverOptions struct {
-	logf   func(format string, args ...interface{})
-	debugf func(format string, args ...interface{})
+	logf        func(format string, args ...interface{})
+	debugf      func(format string, args ...interface{})
+	waitTime    time.Duration
+	minInterval time.Duration
+	tags        []string
+	nodeMeta    map[string]string
+	filter      string
+	datacenter  string
+	passingOnly bool
+
+	failoverDatacenters []string
+	nearest             int
 }
 
 type ResolverOption func(*resolverOptions)
 
+func makeResolverOptions(opts ...ResolverOption) resolverOptions {
+	options := resolverOptions{
+		logf:        func(format string, args ...interface{}) {},
+		debugf:      func(format string, args ...interface{}) {},
+		waitTime:    defaultWaitTime,
+		minInterval: defaultMinInterval,
+		passingOnly: true,
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
 func WithLogger(logf func(format string, args ...interface{})) ResolverOption {
 	return func(o *resolverOptions) {
 		o.logf = logf
@@ -23,16 +57,256 @@ func WithDebug(debugf func(format string, args ...interface{})) ResolverOption {
 	}
 }
 
+// WithWaitTime sets the maximum duration of the blocking queries used to
+// watch for changes to the healthy instances of a service.
+func WithWaitTime(d time.Duration) ResolverOption {
+	return func(o *resolverOptions) {
+		o.waitTime = d
+	}
+}
+
+// WithMinInterval sets the minimum interval between successive queries to
+// the consul agent.
+func WithMinInterval(d time.Duration) ResolverOption {
+	return func(o *resolverOptions) {
+		o.minInterval = d
+	}
+}
+
+// WithTags selects only instances registered with all of the given tags.
+func WithTags(tags ...string) ResolverOption {
+	return func(o *resolverOptions) {
+		o.tags = append(o.tags, tags...)
+	}
+}
+
+// WithNodeMeta selects only instances running on nodes with the given node
+// metadata.
+func WithNodeMeta(key, value string) ResolverOption {
+	return func(o *resolverOptions) {
+		if o.nodeMeta == nil {
+			o.nodeMeta = map[string]string{}
+		}
+		o.nodeMeta[key] = value
+	}
+}
+
+// WithFilter selects instances using a consul filter expression e.g.
+//
+//	Service.Meta.version == "2"
+func WithFilter(expr string) ResolverOption {
+	return func(o *resolverOptions) {
+		o.filter = expr
+	}
+}
+
+// WithDatacenter queries the given datacenter rather than the datacenter of
+// the agent.
+func WithDatacenter(dc string) ResolverOption {
+	return func(o *resolverOptions) {
+		o.datacenter = dc
+	}
+}
+
+// WithPassingOnly determines whether only instances whose checks are all
+// passing are resolved.  Defaults to true.
+func WithPassingOnly(passing bool) ResolverOption {
+	return func(o *resolverOptions) {
+		o.passingOnly = passing
+	}
+}
+
+// WithFailoverDatacenters resolves instances from the first of the given
+// datacenters with healthy instances whenever the local datacenter has none.
+// The resolver returns to the local datacenter once it recovers.
+func WithFailoverDatacenters(dcs ...string) ResolverOption {
+	return func(o *resolverOptions) {
+		o.failoverDatacenters = append(o.failoverDatacenters, dcs...)
+	}
+}
+
+// WithNearest resolves only the n instances closest to the local agent as
+// estimated from the consul network coordinates.  The selection is refreshed
+// whenever the instances change or a blocking query times out.
+func WithNearest(n int) ResolverOption {
+	return func(o *resolverOptions) {
+		o.nearest = n
+	}
+}
+
+// request returns the health query for service described by the options.
+func (o resolverOptions) request(service string) consulapi.HealthConnectRequest {
+	input := consulapi.HealthConnectRequest{
+		Service:    service,
+		Passing:    o.passingOnly,
+		Tags:       o.tags,
+		NodeMeta:   o.nodeMeta,
+		Filter:     o.filter,
+		Datacenter: o.datacenter,
+	}
+	if o.nearest > 0 {
+		input.Near = "_agent"
+	}
+	return input
+}
+
 type serviceOptions struct {
-	healthCheckFunc     func() error
+	checker             HealthChecker
 	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+	id                  string
+	tags                []string
+	meta                map[string]string
+	address             string
+	weights             *consulapi.AgentWeights
+	checkTTL            time.Duration
+	deregisterAfter     time.Duration
+	logf                func(format string, args ...interface{})
+	eventHandler        func(ServiceEvent)
+	syncCtx             context.Context
+	checks              []Check
+	grpcCheck           *grpcCheck
+	sidecar             *sidecar
+	drainPeriod         time.Duration
+	deregisterTimeout   time.Duration
 }
 
 type ServiceOption func(*serviceOptions)
 
+// WithServiceLogger logs failures to register the service.  Defaults to the
+// standard logger.
+func WithServiceLogger(logf func(format string, args ...interface{})) ServiceOption {
+	return func(o *serviceOptions) {
+		o.logf = logf
+	}
+}
+
+// WithSyncRegistration makes NewService register the service before
+// returning, using ctx for the request, and fail with a *RegistrationError
+// when the agent rejects it.  Later registrations, e.g. after the agent
+// restarts, remain in the background.
+func WithSyncRegistration(ctx context.Context) ServiceOption {
+	return func(o *serviceOptions) {
+		o.syncCtx = ctx
+	}
+}
+
+// WithDrainPeriod has Shutdown and Close report the service as critical and
+// wait for d, giving clients time to stop routing to the service, before
+// deregistering it.
+func WithDrainPeriod(d time.Duration) ServiceOption {
+	return func(o *serviceOptions) {
+		o.drainPeriod = d
+	}
+}
+
+// WithDeregisterTimeout bounds the requests made to the agent while shutting
+// down the service.  Defaults to 5s.
+func WithDeregisterTimeout(d time.Duration) ServiceOption {
+	return func(o *serviceOptions) {
+		o.deregisterTimeout = d
+	}
+}
+
+// WithEventHandler calls fn as the service is registered, deregistered,
+// updates its checks or encounters an error.  fn is called synchronously,
+// one event at a time, and should not block.
+func WithEventHandler(fn func(ServiceEvent)) ServiceOption {
+	return func(o *serviceOptions) {
+		o.eventHandler = fn
+	}
+}
+
+// WithServiceID registers the service under id rather than the default,
+// <service>-<hostname>-<port>.
+func WithServiceID(id string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.id = id
+	}
+}
+
+// WithServiceTags registers the service with the given tags.
+func WithServiceTags(tags ...string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.tags = append(o.tags, tags...)
+	}
+}
+
+// WithMeta registers the service with the given metadata.
+func WithMeta(key, value string) ServiceOption {
+	return func(o *serviceOptions) {
+		if o.meta == nil {
+			o.meta = map[string]string{}
+		}
+		o.meta[key] = value
+	}
+}
+
+// WithAddress registers the service at addr rather than the address of the
+// host.
+func WithAddress(addr string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.address = addr
+	}
+}
+
+// WithWeights registers the service with the given load balancing weights
+// for while its checks are passing or warning.
+func WithWeights(passing, warning int) ServiceOption {
+	return func(o *serviceOptions) {
+		o.weights = &consulapi.AgentWeights{Passing: passing, Warning: warning}
+	}
+}
+
+// WithCheckTTL sets the ttl of the health check of the service.  Defaults to
+// three times the health check interval.
+func WithCheckTTL(ttl time.Duration) ServiceOption {
+	return func(o *serviceOptions) {
+		o.checkTTL = ttl
+	}
+}
+
+// WithDeregisterAfter sets how long the health check of the service may be
+// critical before the agent deregisters the service.  Defaults to five times
+// the health check interval.
+func WithDeregisterAfter(d time.Duration) ServiceOption {
+	return func(o *serviceOptions) {
+		o.deregisterAfter = d
+	}
+}
+
+// WithHealthCheckFunc reports the service as critical whenever fn returns
+// an error.  See WithHealthChecker to report warnings.
 func WithHealthCheckFunc(fn func() error) ServiceOption {
 	return func(o *serviceOptions) {
-		o.healthCheckFunc = fn
+		o.checker = errorChecker(fn)
+	}
+}
+
+// WithHealthChecker reports the status and output returned by checker,
+// e.g. one built with CompositeChecker.
+func WithHealthChecker(checker HealthChecker) ServiceOption {
+	return func(o *serviceOptions) {
+		o.checker = checker
+	}
+}
+
+// WithCheck registers an additional ttl check with the service, updated by
+// its own checker at its own interval, alongside the primary check driven by
+// WithHealthChecker or WithHealthCheckFunc.  Each check must have a name and
+// an ID unique among the checks of the service.
+func WithCheck(check Check) ServiceOption {
+	return func(o *serviceOptions) {
+		o.checks = append(o.checks, check)
+	}
+}
+
+// WithHealthCheckTimeout bounds each call of the health checker; a checker
+// that runs longer is reported as critical.  Defaults to the health check
+// interval.
+func WithHealthCheckTimeout(timeout time.Duration) ServiceOption {
+	return func(o *serviceOptions) {
+		o.healthCheckTimeout = timeout
 	}
 }
 
@@ -41,3 +315,68 @@ func WithHealthCheckInterval(interval time.Duration) ServiceOption {
 		o.healthCheckInterval = interval
 	}
 }
+
+type tlsOptions struct {
+	logf            func(format string, args ...interface{})
+	rotationHandler func(RotationEvent)
+	renewBefore     time.Duration
+	minInterval     time.Duration
+}
+
+type TLSOption func(*tlsOptions)
+
+// WithTLSLogger logs failures to refresh the connect certificates.
+func WithTLSLogger(logf func(format string, args ...interface{})) TLSOption {
+	return func(o *tlsOptions) {
+		o.logf = logf
+	}
+}
+
+// WithRotationHandler is called each time the leaf certificate or the CA
+// roots of a TLSSource are replaced.
+func WithRotationHandler(fn func(RotationEvent)) TLSOption {
+	return func(o *tlsOptions) {
+		o.rotationHandler = fn
+	}
+}
+
+// WithRenewBefore fetches a fresh leaf certificate when the current one is
+// within d of expiring.  Defaults to a fifth of the lifetime of the
+// certificate.
+func WithRenewBefore(d time.Duration) TLSOption {
+	return func(o *tlsOptions) {
+		o.renewBefore = d
+	}
+}
+
+type authorizerOptions struct {
+	ttl      time.Duration
+	timeout  time.Duration
+	failOpen bool
+}
+
+type AuthorizerOption func(*authorizerOptions)
+
+// WithAuthorizationTTL sets how long the decision for a client certificate is
+// cached.  Defaults to 10s.
+func WithAuthorizationTTL(ttl time.Duration) AuthorizerOption {
+	return func(o *authorizerOptions) {
+		o.ttl = ttl
+	}
+}
+
+// WithAuthorizationTimeout bounds the requests made to the consul agent by
+// VerifyConnection.  Defaults to 5s.
+func WithAuthorizationTimeout(timeout time.Duration) AuthorizerOption {
+	return func(o *authorizerOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithFailOpen determines whether clients are allowed to connect when the
+// consul agent cannot be reached.  Defaults to false; clients are rejected.
+func WithFailOpen(failOpen bool) AuthorizerOption {
+	return func(o *authorizerOptions) {
+		o.failOpen = failOpen
+	}
+}
@@ -0,0 +1,267 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/savaki/consulapi"
+)
+
+const defaultLocalServiceAddress = "127.0.0.1"
+
+// Upstream is a connect service the proxy makes available to the local
+// service on LocalBindAddress:LocalBindPort.
+type Upstream struct {
+	DestinationName  string
+	Datacenter       string
+	LocalBindAddress string // defaults to 127.0.0.1
+	LocalBindPort    int
+}
+
+// registration returns the upstream as registered with the agent.
+func (u Upstream) registration() consulapi.AgentServiceUpstream {
+	return consulapi.AgentServiceUpstream{
+		DestinationType:  "service",
+		DestinationName:  u.DestinationName,
+		Datacenter:       u.Datacenter,
+		LocalBindAddress: u.LocalBindAddress,
+		LocalBindPort:    u.LocalBindPort,
+	}
+}
+
+// ProxyConfig configures a Proxy.
+type ProxyConfig struct {
+	// Service is the name of the local service the proxy fronts
+	Service string
+	// BindAddress and BindPort are where the proxy accepts inbound connect
+	// connections; a BindPort of 0 selects a free port
+	BindAddress string
+	BindPort    int
+	// LocalServiceAddress and LocalServicePort are where inbound connections
+	// are forwarded; the address defaults to 127.0.0.1
+	LocalServiceAddress string
+	LocalServicePort    int
+	Upstreams           []Upstream
+	// Logf receives errors encountered while proxying
+	Logf func(format string, args ...interface{})
+}
+
+// Proxy provides connect for services that cannot speak connect natively.
+// It registers itself as the connect-proxy of the service, accepts inbound
+// connect connections authorized by intentions and forwards them to the
+// local service, and accepts connections from the local service on the
+// bind port of each upstream and forwards them over connect.
+type Proxy struct {
+	cancel    context.CancelFunc
+	source    *TLSSource
+	service   *Service
+	listeners []net.Listener
+	wg        sync.WaitGroup
+	logf      func(format string, args ...interface{})
+
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// track records the connections so they are closed with the proxy; it
+// returns false when the proxy is already closed.
+func (p *Proxy) track(conns ...net.Conn) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.conns == nil {
+		return false
+	}
+	for _, conn := range conns {
+		p.conns[conn] = struct{}{}
+	}
+	p.wg.Add(len(conns))
+	return true
+}
+
+func (p *Proxy) untrack(conns ...net.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, conn := range conns {
+		delete(p.conns, conn)
+	}
+}
+
+// pipe copies between the two connections until either side is done.
+func (p *Proxy) pipe(a, b net.Conn) {
+	if !p.track(a, b) {
+		a.Close()
+		b.Close()
+		return
+	}
+
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+			p.untrack(a, b)
+		})
+	}
+
+	go func() {
+		defer p.wg.Done()
+		defer closeBoth()
+		io.Copy(a, b)
+	}()
+	go func() {
+		defer p.wg.Done()
+		defer closeBoth()
+		io.Copy(b, a)
+	}()
+}
+
+// serve accepts connections from listener and passes each to fn.
+func (p *Proxy) serve(listener net.Listener, fn func(conn net.Conn)) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fn(conn)
+		}
+	}()
+}
+
+func (p *Proxy) inbound(localAddr string) func(net.Conn) {
+	return func(conn net.Conn) {
+		local, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			p.logf("connect: unable to connect to local service at %v - %v", localAddr, err)
+			conn.Close()
+			return
+		}
+		p.pipe(conn, local)
+	}
+}
+
+func (p *Proxy) outbound(ctx context.Context, health HealthQueryAPI, upstream Upstream) func(net.Conn) {
+	var opts []ResolverOption
+	if upstream.Datacenter != "" {
+		opts = append(opts, WithDatacenter(upstream.Datacenter))
+	}
+
+	return func(conn net.Conn) {
+		remote, err := Dial(ctx, health, p.source, upstream.DestinationName, opts...)
+		if err != nil {
+			p.logf("connect: unable to connect to upstream, %v - %v", upstream.DestinationName, err)
+			conn.Close()
+			return
+		}
+		p.pipe(conn, remote)
+	}
+}
+
+// Close deregisters the proxy and closes its listeners and connections.
+func (p *Proxy) Close() error {
+	p.cancel()
+	for _, listener := range p.listeners {
+		listener.Close()
+	}
+
+	p.mutex.Lock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+	p.mutex.Unlock()
+
+	p.wg.Wait()
+	if p.service != nil {
+		p.service.Close()
+	}
+	return p.source.Close()
+}
+
+// NewProxy starts a connect-proxy for cfg.Service and registers it with
+// the consul agent.  health is used to find the instances of upstreams.
+func NewProxy(agent ConnectAgentAPI, health HealthQueryAPI, cfg ProxyConfig) (*Proxy, error) {
+	if cfg.Service == "" {
+		return nil, errServiceName
+	}
+	if cfg.LocalServiceAddress == "" {
+		cfg.LocalServiceAddress = defaultLocalServiceAddress
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = func(format string, args ...interface{}) {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy := &Proxy{
+		cancel: cancel,
+		logf:   cfg.Logf,
+		conns:  map[net.Conn]struct{}{},
+	}
+
+	source, err := NewTLSSource(ctx, agent, cfg.Service, WithTLSLogger(cfg.Logf))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	proxy.source = source
+
+	listener, err := Listen(source, NewAuthorizer(agent, cfg.Service), net.JoinHostPort(cfg.BindAddress, strconv.Itoa(cfg.BindPort)))
+	if err != nil {
+		proxy.Close()
+		return nil, err
+	}
+	proxy.listeners = append(proxy.listeners, listener)
+
+	localAddr := net.JoinHostPort(cfg.LocalServiceAddress, strconv.Itoa(cfg.LocalServicePort))
+	proxy.serve(listener, proxy.inbound(localAddr))
+
+	var upstreams []consulapi.AgentServiceUpstream
+	for _, upstream := range cfg.Upstreams {
+		if upstream.LocalBindAddress == "" {
+			upstream.LocalBindAddress = defaultLocalServiceAddress
+		}
+
+		l, err := net.Listen("tcp", net.JoinHostPort(upstream.LocalBindAddress, strconv.Itoa(upstream.LocalBindPort)))
+		if err != nil {
+			proxy.Close()
+			return nil, fmt.Errorf("connect: unable to bind upstream, %v: %v", upstream.DestinationName, err)
+		}
+		proxy.listeners = append(proxy.listeners, l)
+		proxy.serve(l, proxy.outbound(ctx, health, upstream))
+
+		upstream.LocalBindPort = l.Addr().(*net.TCPAddr).Port
+		upstreams = append(upstreams, upstream.registration())
+	}
+
+	options := makeServiceOptions(WithServiceLogger(cfg.Logf))
+	registration, err := makeConfig(agent, cfg.Service+"-proxy", listener.Addr().(*net.TCPAddr).Port, options)
+	if err != nil {
+		proxy.Close()
+		return nil, err
+	}
+	registration.kind = consulapi.ServiceKindConnectProxy
+	registration.proxy = &consulapi.AgentServiceProxy{
+		DestinationServiceName: cfg.Service,
+		LocalServiceAddress:    cfg.LocalServiceAddress,
+		LocalServicePort:       cfg.LocalServicePort,
+		Upstreams:              upstreams,
+	}
+
+	service, err := startService(registration, options)
+	if err != nil {
+		proxy.Close()
+		return nil, err
+	}
+	proxy.service = service
+
+	return proxy, nil
+}
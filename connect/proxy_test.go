@@ -0,0 +1,125 @@
+package connect
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/savaki/consulapi"
+)
+
+// serveCopy echoes back everything written to each connection.
+func serveCopy(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// waitForRegistration returns the first service registered with agent.
+func waitForRegistration(t *testing.T, agent *AgentMock) consulapi.AgentServiceRegistration {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		agent.mutex.Lock()
+		registrations := agent.registrations
+		agent.mutex.Unlock()
+
+		if len(registrations) > 0 {
+			return registrations[0]
+		}
+	}
+	t.Fatalf("timed out waiting for registration")
+	return consulapi.AgentServiceRegistration{}
+}
+
+func TestProxy(t *testing.T) {
+	var (
+		ca        = NewTestCA(t, testTrustDomain)
+		localPort = serveCopy(t)
+		upPort    = freePort(t)
+		dbAgent   = &AgentMock{
+			CAMock:        NewCAMock(ca),
+			AuthorizeMock: &AuthorizeMock{allowed: map[string]bool{"web": true}},
+		}
+		webAgent = &AgentMock{
+			CAMock:        NewCAMock(ca),
+			AuthorizeMock: &AuthorizeMock{},
+		}
+	)
+
+	db, err := NewProxy(dbAgent, nil, ProxyConfig{
+		Service:          "db",
+		BindAddress:      "127.0.0.1",
+		LocalServicePort: localPort,
+	})
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer db.Close()
+
+	registration := waitForRegistration(t, dbAgent)
+	if got, want := registration.Kind, consulapi.ServiceKindConnectProxy; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := registration.Proxy.DestinationServiceName, "db"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := registration.Proxy.LocalServicePort, localPort; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	web, err := NewProxy(webAgent, healthAt(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(registration.Port))), ProxyConfig{
+		Service: "web",
+		Upstreams: []Upstream{
+			{DestinationName: "db", LocalBindPort: upPort},
+		},
+	})
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer web.Close()
+
+	if got, want := waitForRegistration(t, webAgent).Proxy.Upstreams[0].LocalBindPort, upPort; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(upPort)))
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := string(data), "hello"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestProxy_MissingService(t *testing.T) {
+	if _, err := NewProxy(&AgentMock{}, nil, ProxyConfig{}); err != errServiceName {
+		t.Fatalf("got %v; want %v", err, errServiceName)
+	}
+}
@@ -2,6 +2,7 @@ package connect
 
 import (
 	"context"
+	"reflect"
 	"sort"
 	"strconv"
 	"sync"
@@ -11,90 +12,109 @@ import (
 	"google.golang.org/grpc/naming"
 )
 
+// HealthAPI is the health api used by NewResolver.
 type HealthAPI interface {
 	Connect(ctx context.Context, service string, passing bool) ([]consulapi.HealthServiceEntry, error)
 }
 
+// HealthQueryAPI is the health api used to watch and dial connect services.
+// *consulapi.Health implements both HealthQueryAPI and HealthAPI.
+type HealthQueryAPI interface {
+	ConnectQuery(ctx context.Context, input consulapi.HealthConnectRequest) (consulapi.HealthConnectResponse, error)
+}
+
+// healthQuery adapts a HealthAPI to HealthQueryAPI.  Queries never block and
+// only the service and passing fields of the request are honored.
+type healthQuery struct {
+	client HealthAPI
+}
+
+func (h healthQuery) ConnectQuery(ctx context.Context, input consulapi.HealthConnectRequest) (consulapi.HealthConnectResponse, error) {
+	entries, err := h.client.Connect(ctx, input.Service, input.Passing)
+	if err != nil {
+		return consulapi.HealthConnectResponse{}, err
+	}
+	return consulapi.HealthConnectResponse{Entries: entries}, nil
+}
+
 type watcher struct {
 	ctx     context.Context
 	cancel  context.CancelFunc
-	client  HealthAPI
+	watch   *healthWatch
 	service string
 	logf    func(format string, args ...interface{})
 	debugf  func(format string, args ...interface{})
 
 	mutex    sync.Mutex
-	previous []consulapi.HealthServiceEntry
+	previous map[string]*Instance
 }
 
-func (w *watcher) poll() ([]*naming.Update, error) {
-	ctx, cancel := context.WithTimeout(w.ctx, 30*time.Second)
-	defer cancel()
+// Next blocks until the healthy instances of the service change and returns
+// the resulting updates.
+func (w *watcher) Next() ([]*naming.Update, error) {
+	for {
+		services, err := w.watch.next(w.ctx)
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return nil, w.ctx.Err()
+			}
 
-	services, err := w.client.Connect(ctx, w.service, true)
-	if err != nil {
-		return nil, err
-	}
-	sort.Slice(services, func(i, j int) bool { return services[i].Service.ID < services[j].Service.ID })
+			w.logf("consul resolver: unable to watch service, %v - %v", w.service, err)
+			select {
+			case <-w.ctx.Done():
+				return nil, w.ctx.Err()
+			case <-time.After(retryInterval):
+				w.logf("retrying poll ...")
+			}
+			continue
+		}
 
-	w.mutex.Lock()
-	updates := w.makeUpdates(w.previous, services)
-	w.previous = services
-	w.mutex.Unlock()
+		latest := instancesByAddr(services)
 
-	return updates, nil
-}
+		w.mutex.Lock()
+		updates := w.makeUpdates(w.previous, latest)
+		w.previous = latest
+		w.mutex.Unlock()
 
-func (w *watcher) Next() ([]*naming.Update, error) {
-	for {
-		updates, err := w.poll()
-		if err == nil {
-			w.debugf("found updates for service, %v - %#v", w.service, updates)
-			return updates, nil
+		if len(updates) == 0 {
+			continue
 		}
 
-		select {
-		case <-w.ctx.Done():
-			return nil, w.ctx.Err()
-		case <-time.After(15 * time.Second):
-			w.logf("retrying poll ...")
-		}
+		w.debugf("found updates for service, %v - %#v", w.service, updates)
+		return updates, nil
 	}
 }
 
-func (w *watcher) makeUpdates(previous, latest []consulapi.HealthServiceEntry) []*naming.Update {
+// makeUpdates returns the updates that transform the address set, previous,
+// into latest.  An address whose metadata changed is deleted and added again
+// with the new metadata.  Addresses that are unchanged retain their previous
+// metadata in latest so later deletes match what was originally added.
+func (w *watcher) makeUpdates(previous, latest map[string]*Instance) []*naming.Update {
 	var updates []*naming.Update
 
-	// adds
-addLoop:
-	for _, l := range latest {
-		for _, p := range previous {
-			if l.Service.ID == p.Service.ID {
-				continue addLoop
-			}
-		}
+	for _, addr := range sortedAddrs(previous, latest) {
+		p, inPrevious := previous[addr]
+		l, inLatest := latest[addr]
 
-		w.logf("consul resolver: adding endpoint, %v:%v, to service, %v", l.Service.Address, l.Service.Port, w.service)
-		updates = append(updates, &naming.Update{
-			Op:   naming.Add,
-			Addr: hostAndPort(l.Service.Address, l.Service.Port),
-		})
-	}
+		switch {
+		case !inPrevious:
+			w.logf("consul resolver: adding endpoint, %v, to service, %v", addr, w.service)
+			updates = append(updates, &naming.Update{Op: naming.Add, Addr: addr, Metadata: l})
 
-	// deletes
-deleteLoop:
-	for _, p := range previous {
-		for _, l := range latest {
-			if p.Service.ID == l.Service.ID {
-				continue deleteLoop
-			}
-		}
+		case !inLatest:
+			w.logf("consul resolver: removing endpoint, %v, from service, %v", addr, w.service)
+			updates = append(updates, &naming.Update{Op: naming.Delete, Addr: addr, Metadata: p})
 
-		w.logf("consul resolver: removing endpoint, %v:%v, from service, %v", p.Service.Address, p.Service.Port, w.service)
-		updates = append(updates, &naming.Update{
-			Op:   naming.Delete,
-			Addr: hostAndPort(p.Service.Address, p.Service.Port),
-		})
+		case sameMetadata(p, l):
+			latest[addr] = p
+
+		default:
+			w.logf("consul resolver: updating endpoint, %v, of service, %v", addr, w.service)
+			updates = append(updates,
+				&naming.Update{Op: naming.Delete, Addr: addr, Metadata: p},
+				&naming.Update{Op: naming.Add, Addr: addr, Metadata: l},
+			)
+		}
 	}
 
 	return updates
@@ -104,43 +124,85 @@ func (w *watcher) Close() {
 	w.cancel()
 }
 
-type resolver struct {
-	client  HealthAPI
+type namingResolver struct {
+	client  HealthQueryAPI
 	service string
-	logf    func(format string, args ...interface{})
-	debugf  func(format string, args ...interface{})
+	options resolverOptions
 }
 
-func (r *resolver) Resolve(_ string) (naming.Watcher, error) {
+func (r *namingResolver) Resolve(_ string) (naming.Watcher, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &watcher{
 		ctx:     ctx,
 		cancel:  cancel,
-		client:  r.client,
+		watch:   newHealthWatch(r.client, r.options.request(r.service), r.options),
 		service: r.service,
-		logf:    r.logf,
-		debugf:  r.debugf,
+		logf:    r.options.logf,
+		debugf:  r.options.debugf,
 	}, nil
 }
 
+// NewResolver returns a naming.Resolver for use with grpc.RoundRobin.  When
+// client also implements HealthQueryAPI, as *consulapi.Health does, the
+// service is watched with blocking queries; otherwise client is polled every
+// min interval and the tag, node meta, filter, datacenter and nearest
+// options are ignored.
+//
+// Deprecated: the grpc naming package is deprecated; dial a consul:// target
+// using the resolver.Builder returned by NewBuilder instead.
 func NewResolver(client HealthAPI, service string, opts ...ResolverOption) naming.Resolver {
-	options := resolverOptions{
-		logf:   func(format string, args ...interface{}) {},
-		debugf: func(format string, args ...interface{}) {},
+	query, ok := client.(HealthQueryAPI)
+	if !ok {
+		query = healthQuery{client: client}
 	}
 
-	for _, opt := range opts {
-		opt(&options)
-	}
-
-	return &resolver{
-		client:  client,
+	return &namingResolver{
+		client:  query,
 		service: service,
-		logf:    options.logf,
-		debugf:  options.debugf,
+		options: makeResolverOptions(opts...),
 	}
 }
 
 func hostAndPort(host string, port int) string {
 	return host + ":" + strconv.Itoa(port)
 }
+
+// instancesByAddr indexes the instances of entries by host:port.  When
+// several instances share an address, the instance with the lowest ID wins.
+func instancesByAddr(entries []consulapi.HealthServiceEntry) map[string]*Instance {
+	instances := make(map[string]*Instance, len(entries))
+	for _, entry := range entries {
+		addr := entryAddr(entry)
+		instance := newInstance(entry)
+		if existing, ok := instances[addr]; ok && existing.ID < instance.ID {
+			continue
+		}
+		instances[addr] = &instance
+	}
+	return instances
+}
+
+// sortedAddrs returns the union of the addresses in sets in sorted order.
+func sortedAddrs(sets ...map[string]*Instance) []string {
+	var addrs []string
+	seen := map[string]struct{}{}
+	for _, set := range sets {
+		for addr := range set {
+			if _, ok := seen[addr]; ok {
+				continue
+			}
+			seen[addr] = struct{}{}
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// sameMetadata reports whether a and b differ only by service ID, as happens
+// when an instance is re-registered at the same address.
+func sameMetadata(a, b *Instance) bool {
+	x, y := *a, *b
+	x.ID, y.ID = "", ""
+	return reflect.DeepEqual(x, y)
+}
@@ -5,24 +5,59 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/savaki/consulapi"
 	"google.golang.org/grpc/naming"
 )
 
 type Mock struct {
+	mutex   sync.Mutex
 	entries [][]consulapi.HealthServiceEntry
+	indexes []int64
+	inputs  []consulapi.HealthConnectRequest
 }
 
-func (m *Mock) Connect(ctx context.Context, service string, passing bool) ([]consulapi.HealthServiceEntry, error) {
+func (m *Mock) ConnectQuery(ctx context.Context, input consulapi.HealthConnectRequest) (consulapi.HealthConnectResponse, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.inputs = append(m.inputs, input)
 	if len(m.entries) == 0 {
-		return nil, nil
+		return consulapi.HealthConnectResponse{}, nil
+	}
+
+	var index int64
+	if len(m.indexes) > 0 {
+		index = m.indexes[0]
+		m.indexes = m.indexes[1:]
 	}
 
 	head := m.entries[0]
 	m.entries = m.entries[1:]
-	return head, nil
+	return consulapi.HealthConnectResponse{Entries: head, Index: index}, nil
+}
+
+func (m *Mock) Connect(ctx context.Context, service string, passing bool) ([]consulapi.HealthServiceEntry, error) {
+	output, err := m.ConnectQuery(ctx, consulapi.HealthConnectRequest{Service: service, Passing: passing})
+	return output.Entries, err
+}
+
+// ConnectMock implements only HealthAPI, as callers of NewResolver may.
+type ConnectMock struct {
+	mutex    sync.Mutex
+	entries  []consulapi.HealthServiceEntry
+	services []string
+}
+
+func (m *ConnectMock) Connect(ctx context.Context, service string, passing bool) ([]consulapi.HealthServiceEntry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.services = append(m.services, service)
+	return m.entries, nil
 }
 
 func TestResolver(t *testing.T) {
@@ -40,7 +75,7 @@ func TestResolver(t *testing.T) {
 	}
 	m := &Mock{entries: entries}
 	s := "blah"
-	r := NewResolver(m, s, WithLogger(log.Printf))
+	r := NewResolver(m, s, WithLogger(log.Printf), WithMinInterval(time.Millisecond))
 	watcher, err := r.Resolve("")
 	if err != nil {
 		t.Fatalf("got %v; want nil", err)
@@ -53,10 +88,12 @@ func TestResolver(t *testing.T) {
 		t.Fatalf("got %v; want nil", err)
 	}
 
+	instance := &Instance{ID: a.Service.ID, Service: a.Service.Service, Weight: 1}
 	want := []*naming.Update{
 		{
-			Op:   naming.Add,
-			Addr: fmt.Sprintf("%v:%v", a.Service.Address, a.Service.Port),
+			Op:       naming.Add,
+			Addr:     fmt.Sprintf("%v:%v", a.Service.Address, a.Service.Port),
+			Metadata: instance,
 		},
 	}
 	if !reflect.DeepEqual(got, want) {
@@ -72,21 +109,177 @@ func TestResolver(t *testing.T) {
 
 	want = []*naming.Update{
 		{
-			Op:   naming.Delete,
-			Addr: fmt.Sprintf("%v:%v", a.Service.Address, a.Service.Port),
+			Op:       naming.Delete,
+			Addr:     fmt.Sprintf("%v:%v", a.Service.Address, a.Service.Port),
+			Metadata: instance,
 		},
 	}
 	if !reflect.DeepEqual(got, want) {
 		t.Fatalf("got %v; want %v", watcher, entries)
 	}
 
-	// test 3 - no change
+	// test 3 - no change blocks until closed
 	//
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		watcher.Close()
+	}()
 	got, err = watcher.Next()
-	if err != nil {
-		t.Fatalf("got %v; want nil", err)
+	if err != context.Canceled {
+		t.Fatalf("got %v; want %v", err, context.Canceled)
 	}
 	if len(got) != 0 {
 		t.Fatalf("got %v; want 0", len(got))
 	}
 }
+
+func TestResolver_HealthAPI(t *testing.T) {
+	m := &ConnectMock{
+		entries: []consulapi.HealthServiceEntry{
+			{Service: consulapi.HealthService{ID: "a1", Service: "blah", Address: "a3", Port: 1}},
+		},
+	}
+	r := NewResolver(m, "blah", WithMinInterval(time.Millisecond))
+	w, err := r.Resolve("")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer w.Close()
+
+	got, err := w.Next()
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	want := []*naming.Update{
+		{
+			Op:       naming.Add,
+			Addr:     "a3:1",
+			Metadata: &Instance{ID: "a1", Service: "blah", Weight: 1},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := m.services[0], "blah"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestResolver_Options(t *testing.T) {
+	m := &Mock{entries: [][]consulapi.HealthServiceEntry{{}}}
+	r := NewResolver(m, "blah",
+		WithTags("canary"),
+		WithNodeMeta("rack", "r1"),
+		WithFilter(`Service.Meta.version == "2"`),
+		WithDatacenter("east"),
+		WithPassingOnly(false),
+	)
+	w, err := r.Resolve("")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer w.Close()
+
+	if _, err := w.(*watcher).watch.next(context.Background()); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	want := consulapi.HealthConnectRequest{
+		Service:    "blah",
+		Tags:       []string{"canary"},
+		NodeMeta:   map[string]string{"rack": "r1"},
+		Filter:     `Service.Meta.version == "2"`,
+		Datacenter: "east",
+		WaitTime:   defaultWaitTime,
+	}
+	if got := m.inputs[0]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestWatcher_MakeUpdates(t *testing.T) {
+	entry := func(id, addr string, tags ...string) consulapi.HealthServiceEntry {
+		return consulapi.HealthServiceEntry{
+			Service: consulapi.HealthService{ID: id, Service: "svc", Address: addr, Port: 80, Tags: tags},
+		}
+	}
+	instance := func(id string, tags ...string) *Instance {
+		return &Instance{ID: id, Service: "svc", Tags: tags, Weight: 1}
+	}
+
+	testCases := map[string]struct {
+		Steps [][]consulapi.HealthServiceEntry
+		Want  [][]*naming.Update
+	}{
+		"id churn": {
+			Steps: [][]consulapi.HealthServiceEntry{
+				{entry("a1", "x")},
+				{entry("a2", "x")},
+				{},
+			},
+			Want: [][]*naming.Update{
+				{{Op: naming.Add, Addr: "x:80", Metadata: instance("a1")}},
+				nil,
+				{{Op: naming.Delete, Addr: "x:80", Metadata: instance("a1")}},
+			},
+		},
+		"address move": {
+			Steps: [][]consulapi.HealthServiceEntry{
+				{entry("a1", "x")},
+				{entry("a1", "y")},
+			},
+			Want: [][]*naming.Update{
+				{{Op: naming.Add, Addr: "x:80", Metadata: instance("a1")}},
+				{
+					{Op: naming.Delete, Addr: "x:80", Metadata: instance("a1")},
+					{Op: naming.Add, Addr: "y:80", Metadata: instance("a1")},
+				},
+			},
+		},
+		"duplicate addresses": {
+			Steps: [][]consulapi.HealthServiceEntry{
+				{entry("a1", "x"), entry("a2", "x")},
+				{entry("a2", "x")},
+				{},
+			},
+			Want: [][]*naming.Update{
+				{{Op: naming.Add, Addr: "x:80", Metadata: instance("a1")}},
+				nil,
+				{{Op: naming.Delete, Addr: "x:80", Metadata: instance("a1")}},
+			},
+		},
+		"metadata change": {
+			Steps: [][]consulapi.HealthServiceEntry{
+				{entry("a1", "x", "v1")},
+				{entry("a1", "x", "v2")},
+			},
+			Want: [][]*naming.Update{
+				{{Op: naming.Add, Addr: "x:80", Metadata: instance("a1", "v1")}},
+				{
+					{Op: naming.Delete, Addr: "x:80", Metadata: instance("a1", "v1")},
+					{Op: naming.Add, Addr: "x:80", Metadata: instance("a1", "v2")},
+				},
+			},
+		},
+	}
+
+	for label, tc := range testCases {
+		t.Run(label, func(t *testing.T) {
+			w := &watcher{
+				service: "svc",
+				logf:    func(format string, args ...interface{}) {},
+			}
+
+			var previous map[string]*Instance
+			for i, step := range tc.Steps {
+				latest := instancesByAddr(step)
+				got := w.makeUpdates(previous, latest)
+				if !reflect.DeepEqual(got, tc.Want[i]) {
+					t.Fatalf("step %v: got %v; want %v", i, got, tc.Want[i])
+				}
+				previous = latest
+			}
+		})
+	}
+}
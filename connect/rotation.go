@@ -0,0 +1,212 @@
+package connect
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/savaki/consulapi"
+)
+
+// renewRetryInterval is the interval between requests for a fresh leaf
+// certificate while the agent has yet to renew one that is due for renewal.
+const renewRetryInterval = 5 * time.Second
+
+// RotationKind identifies what was replaced by a rotation.
+type RotationKind string
+
+const (
+	RotationLeaf  RotationKind = "leaf"
+	RotationRoots RotationKind = "roots"
+)
+
+// RotationEvent describes the replacement of the leaf certificate or the CA
+// roots of a TLSSource.
+type RotationEvent struct {
+	Kind         RotationKind
+	Service      string
+	SerialNumber string
+	ValidBefore  time.Time
+	ActiveRootID string
+}
+
+// sleep waits for d or until ctx is done and reports whether ctx is still
+// live.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (s *TLSSource) watch(ctx context.Context) {
+	defer close(s.done)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.watchLeaf(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.watchRoots(ctx)
+	}()
+	wg.Wait()
+}
+
+// renewAt returns the time from which a fresh leaf certificate is requested.
+func (s *TLSSource) renewAt(leaf consulapi.AgentConnectCALeaf) time.Time {
+	renewBefore := s.options.renewBefore
+	if renewBefore <= 0 {
+		renewBefore = leaf.ValidBefore.Sub(leaf.ValidAfter) / 5
+	}
+	return leaf.ValidBefore.Add(-renewBefore)
+}
+
+func (s *TLSSource) queryLeaf(ctx context.Context, input consulapi.AgentConnectCALeafRequest) (consulapi.AgentConnectCALeaf, error) {
+	ctx, cancel := context.WithTimeout(ctx, blockingTimeout(input.WaitTime))
+	defer cancel()
+
+	return s.agent.ConnectCALeafQuery(ctx, input)
+}
+
+func (s *TLSSource) watchLeaf(ctx context.Context) {
+	var last time.Time
+	for {
+		if !sleep(ctx, time.Until(last.Add(s.options.minInterval))) {
+			return
+		}
+		last = time.Now()
+
+		current := s.load().leaf
+		input := consulapi.AgentConnectCALeafRequest{
+			Service:   s.service,
+			WaitIndex: current.ModifyIndex,
+			WaitTime:  defaultWaitTime,
+		}
+
+		renew := time.Until(s.renewAt(current))
+		if renew <= 0 {
+			input.WaitIndex = 0
+		} else if renew < input.WaitTime {
+			input.WaitTime = renew
+		}
+
+		leaf, err := s.queryLeaf(ctx, input)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.options.logf("connect: unable to fetch leaf certificate for service, %v - %v", s.service, err)
+			if !sleep(ctx, retryInterval) {
+				return
+			}
+			continue
+		}
+
+		if leaf.SerialNumber == current.SerialNumber {
+			if renew <= 0 && !sleep(ctx, renewRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		if err := s.update(&leaf, nil); err != nil {
+			s.options.logf("connect: unable to rotate leaf certificate for service, %v - %v", s.service, err)
+			if !sleep(ctx, retryInterval) {
+				return
+			}
+		}
+	}
+}
+
+func (s *TLSSource) queryRoots(ctx context.Context, input consulapi.AgentConnectCARootsRequest) (consulapi.AgentConnectCARoots, error) {
+	ctx, cancel := context.WithTimeout(ctx, blockingTimeout(input.WaitTime))
+	defer cancel()
+
+	return s.agent.ConnectCARootsQuery(ctx, input)
+}
+
+func (s *TLSSource) watchRoots(ctx context.Context) {
+	var last time.Time
+	for {
+		if !sleep(ctx, time.Until(last.Add(s.options.minInterval))) {
+			return
+		}
+		last = time.Now()
+
+		current := s.load().roots
+		roots, err := s.queryRoots(ctx, consulapi.AgentConnectCARootsRequest{
+			WaitIndex: current.Index,
+			WaitTime:  defaultWaitTime,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.options.logf("connect: unable to fetch CA roots - %v", err)
+			if !sleep(ctx, retryInterval) {
+				return
+			}
+			continue
+		}
+
+		if reflect.DeepEqual(roots, current) {
+			continue
+		}
+
+		if err := s.update(nil, &roots); err != nil {
+			s.options.logf("connect: unable to rotate CA roots - %v", err)
+			if !sleep(ctx, retryInterval) {
+				return
+			}
+		}
+	}
+}
+
+// update replaces the leaf certificate or the CA roots of the source.
+func (s *TLSSource) update(leaf *consulapi.AgentConnectCALeaf, roots *consulapi.AgentConnectCARoots) error {
+	s.mutex.Lock()
+	current := s.load()
+
+	kind := RotationLeaf
+	nextLeaf, nextRoots := current.leaf, current.roots
+	if leaf != nil {
+		nextLeaf = *leaf
+	}
+	if roots != nil {
+		kind = RotationRoots
+		nextRoots = *roots
+	}
+
+	state, err := newTLSState(nextLeaf, nextRoots)
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	s.state.Store(state)
+	s.mutex.Unlock()
+
+	if s.options.rotationHandler != nil {
+		s.options.rotationHandler(RotationEvent{
+			Kind:         kind,
+			Service:      s.service,
+			SerialNumber: nextLeaf.SerialNumber,
+			ValidBefore:  nextLeaf.ValidBefore,
+			ActiveRootID: nextRoots.ActiveRootID,
+		})
+	}
+
+	return nil
+}
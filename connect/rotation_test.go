@@ -0,0 +1,137 @@
+package connect
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func withMinInterval(d time.Duration) TLSOption {
+	return func(o *tlsOptions) {
+		o.minInterval = d
+	}
+}
+
+func currentSerial(t *testing.T, source *TLSSource) string {
+	cert, err := x509.ParseCertificate(source.getCertificate().Certificate[0])
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	return cert.SerialNumber.Text(16)
+}
+
+func waitForEvent(t *testing.T, events chan RotationEvent) RotationEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for rotation")
+		return RotationEvent{}
+	}
+}
+
+func TestTLSSource_RotateLeaf(t *testing.T) {
+	m := NewCAMock(NewTestCA(t, testTrustDomain))
+	events := make(chan RotationEvent, 1)
+	source, err := NewTLSSource(context.Background(), m, "web",
+		WithRotationHandler(func(event RotationEvent) { events <- event }),
+		withMinInterval(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer source.Close()
+
+	leaf := m.Rotate("web", time.Hour)
+
+	event := waitForEvent(t, events)
+	if got, want := event.Kind, RotationLeaf; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := event.SerialNumber, leaf.SerialNumber; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := currentSerial(t, source), leaf.SerialNumber; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestTLSSource_RotateRoots(t *testing.T) {
+	m := NewCAMock(NewTestCA(t, testTrustDomain))
+	events := make(chan RotationEvent, 2)
+	source, err := NewTLSSource(context.Background(), m, "web",
+		WithRotationHandler(func(event RotationEvent) { events <- event }),
+		withMinInterval(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer source.Close()
+
+	ca := NewTestCA(t, testTrustDomain)
+	m.RotateRoots(ca, "root-2")
+
+	event := waitForEvent(t, events)
+	if got, want := event.Kind, RotationRoots; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := event.ActiveRootID, "root-2"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	// peers with certificates from the new CA are now trusted
+	block, _ := pem.Decode([]byte(ca.Leaf("db", time.Hour).CertPEM))
+	if _, err := source.verifyPeer([][]byte{block.Bytes}, "db"); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+}
+
+func TestTLSSource_RenewBeforeExpiry(t *testing.T) {
+	m := NewCAMock(NewTestCA(t, testTrustDomain))
+	m.Rotate("web", 10*time.Minute)
+
+	source, err := NewTLSSource(context.Background(), m, "web",
+		WithRenewBefore(time.Hour),
+		withMinInterval(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer source.Close()
+
+	// the certificate is due for renewal so the source requests a fresh
+	// certificate without blocking
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		inputs := m.Inputs()
+		if len(inputs) >= 2 {
+			if got := inputs[1].WaitIndex; got != 0 {
+				t.Fatalf("got %v; want 0", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for renewal")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTLSSource_RenewAt(t *testing.T) {
+	now := time.Now()
+	m := NewCAMock(NewTestCA(t, testTrustDomain))
+	source, err := NewTLSSource(context.Background(), m, "web")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer source.Close()
+
+	leaf := source.load().leaf
+	leaf.ValidAfter = now
+	leaf.ValidBefore = now.Add(100 * time.Hour)
+	if got, want := source.renewAt(leaf), now.Add(80*time.Hour); !got.Equal(want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
@@ -2,27 +2,34 @@ package connect
 
 import (
 	"context"
-	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/savaki/consulapi"
 )
 
-const defaultHealthCheckInterval = 3 * time.Second
+const (
+	defaultHealthCheckInterval = 3 * time.Second
 
-var r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	defaultDeregisterTimeout = 5 * time.Second
 
-func guid() string {
-	data := make([]byte, 16)
-	_, err := r.Read(data)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return hex.EncodeToString(data)
-}
+	// outputShutdown is the output of the primary check while draining
+	outputShutdown = "service is shutting down"
+
+	minRetryInterval = time.Second
+	maxRetryInterval = 30 * time.Second
+)
+
+var (
+	errServiceName = errors.New("connect: service name is required")
+	errCheckName   = errors.New("connect: check name is required")
+)
 
 type AgentAPI interface {
 	ServiceRegister(ctx context.Context, registration consulapi.AgentServiceRegistration) error
@@ -30,125 +37,569 @@ type AgentAPI interface {
 	UpdateTTL(ctx context.Context, status consulapi.Status, checkID, output string) error
 }
 
+// ttlCheck is a ttl check of a service along with the runner of the checker
+// that drives it.  The runner is shared by copies of the check so that it
+// outlives re-registrations of the service.
+type ttlCheck struct {
+	id       string
+	name     string
+	notes    string
+	interval time.Duration
+	ttl      time.Duration
+	runner   *checkRunner
+}
+
+func (c ttlCheck) registration() *consulapi.AgentServiceCheck {
+	return &consulapi.AgentServiceCheck{
+		CheckID: c.id,
+		Name:    c.name,
+		Notes:   c.notes,
+		TTL:     makeTTL(c.ttl),
+	}
+}
+
 type config struct {
-	service             string
-	port                int
-	healthCheckInterval time.Duration
-	healthCheckFunc     func() error
-	client              AgentAPI
+	service         string
+	id              string
+	port            int
+	address         string
+	tags            []string
+	meta            map[string]string
+	weights         *consulapi.AgentWeights
+	kind            consulapi.ServiceKind
+	proxy           *consulapi.AgentServiceProxy
+	checks          []ttlCheck // the first is the primary check of the service
+	nativeChecks    []*consulapi.AgentServiceCheck
+	sidecar         *sidecar
+	deregisterAfter time.Duration
+	client          AgentAPI
 }
 
-func registerAndUpdate(ctx context.Context, config config) error {
-	var (
-		serviceID = guid()
-		checkID   = guid()
-	)
+// defaultServiceID returns an ID that is stable across registrations of the
+// same service on the same host, <service>-<hostname>-<port>.
+// When the hostname is unavailable a random uuid takes its place.
+func defaultServiceID(service string, port int) (string, error) {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		if host, err = guid(); err != nil {
+			return "", err
+		}
+	}
+	return service + "-" + host + "-" + strconv.Itoa(port), nil
+}
 
-	registration := consulapi.AgentServiceRegistration{
-		Kind: consulapi.ServiceKindTypical,
-		ID:   serviceID,
-		Name: config.service,
-		Port: config.port,
-		Check: &consulapi.AgentServiceCheck{
-			CheckID:                        checkID,
-			TTL:                            makeTTL(config.healthCheckInterval * 3),
-			DeregisterCriticalServiceAfter: makeTTL(config.healthCheckInterval * 5),
+// makeCheck fills in the defaults of check, a check of the service with ID
+// serviceID, from options.
+func makeCheck(serviceID string, check Check, options serviceOptions) ttlCheck {
+	c := ttlCheck{
+		id:       check.ID,
+		name:     check.Name,
+		notes:    check.Notes,
+		interval: check.Interval,
+		ttl:      check.TTL,
+		runner: &checkRunner{
+			checker: check.Checker,
+			timeout: check.Timeout,
 		},
-		Connect: &consulapi.AgentServiceConnect{
+	}
+	if c.id == "" {
+		c.id = "service:" + serviceID + ":" + check.Name
+	}
+	if c.interval <= 0 {
+		c.interval = options.healthCheckInterval
+	}
+	if c.runner.timeout <= 0 {
+		c.runner.timeout = c.interval
+	}
+	if c.ttl <= 0 {
+		c.ttl = c.interval * 3
+	}
+	if c.runner.checker == nil {
+		c.runner.checker = passing
+	}
+	return c
+}
+
+func makeConfig(agent AgentAPI, service string, port int, options serviceOptions) (config, error) {
+	id := options.id
+	if id == "" {
+		var err error
+		if id, err = defaultServiceID(service, port); err != nil {
+			return config{}, err
+		}
+	}
+
+	deregisterAfter := options.deregisterAfter
+	if deregisterAfter <= 0 {
+		deregisterAfter = options.healthCheckInterval * 5
+	}
+
+	checks := []ttlCheck{
+		makeCheck(id, Check{
+			ID:      "service:" + id,
+			Timeout: options.healthCheckTimeout,
+			TTL:     options.checkTTL,
+			Checker: options.checker,
+		}, options),
+	}
+	for _, check := range options.checks {
+		if check.Name == "" {
+			return config{}, errCheckName
+		}
+		checks = append(checks, makeCheck(id, check, options))
+	}
+
+	var nativeChecks []*consulapi.AgentServiceCheck
+	if options.grpcCheck != nil {
+		if options.sidecar == nil {
+			return config{}, errGRPCCheckNative
+		}
+		check := *options.grpcCheck
+		if check.interval <= 0 {
+			check.interval = options.healthCheckInterval
+		}
+		nativeChecks = append(nativeChecks, check.registration(id, options.address, port))
+	}
+
+	// the agent keeps one check per ID
+	checkIDs := map[string]bool{}
+	for _, check := range checks {
+		if checkIDs[check.id] {
+			return config{}, fmt.Errorf("connect: duplicate check id, %v", check.id)
+		}
+		checkIDs[check.id] = true
+	}
+	for _, check := range nativeChecks {
+		if checkIDs[check.CheckID] {
+			return config{}, fmt.Errorf("connect: duplicate check id, %v", check.CheckID)
+		}
+		checkIDs[check.CheckID] = true
+	}
+
+	return config{
+		service:         service,
+		id:              id,
+		port:            port,
+		address:         options.address,
+		tags:            options.tags,
+		meta:            options.meta,
+		weights:         options.weights,
+		checks:          checks,
+		nativeChecks:    nativeChecks,
+		sidecar:         options.sidecar,
+		deregisterAfter: deregisterAfter,
+		client:          agent,
+	}, nil
+}
+
+// ServiceEventKind identifies a change in the lifecycle of a Service.
+type ServiceEventKind string
+
+const (
+	ServiceRegistered   ServiceEventKind = "registered"
+	ServiceDeregistered ServiceEventKind = "deregistered"
+	CheckUpdated        ServiceEventKind = "check-updated"
+	ServiceError        ServiceEventKind = "error"
+)
+
+// ServiceEvent describes a change in the lifecycle of a Service.
+type ServiceEvent struct {
+	Kind      ServiceEventKind
+	ServiceID string
+	// CheckID, Status and Output are the check and status reported for
+	// CheckUpdated
+	CheckID string
+	Status  consulapi.Status
+	Output  string
+	// Err is the error for ServiceError
+	Err error
+}
+
+// Service keeps a service registered with the consul agent and its ttl check
+// updated until closed.
+type Service struct {
+	config  config
+	cancel  context.CancelFunc
+	done    chan struct{}
+	options serviceOptions
+
+	registered     chan struct{}
+	registeredOnce sync.Once
+
+	eventMutex sync.Mutex // serializes calls of the event handler
+
+	mutex  sync.Mutex
+	status consulapi.Status
+	output string
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+func (s *Service) emit(event ServiceEvent) {
+	event.ServiceID = s.config.id
+	if s.options.eventHandler != nil {
+		// the checks of the service are updated concurrently
+		s.eventMutex.Lock()
+		defer s.eventMutex.Unlock()
+		s.options.eventHandler(event)
+	}
+}
+
+func (s *Service) setStatus(checkID string, primary bool, status consulapi.Status, output string) {
+	if primary {
+		s.mutex.Lock()
+		s.status, s.output = status, output
+		s.mutex.Unlock()
+	}
+
+	s.emit(ServiceEvent{Kind: CheckUpdated, CheckID: checkID, Status: status, Output: output})
+}
+
+// RegistrationError is returned by NewService with WithSyncRegistration
+// when the agent rejects the registration of the service.
+type RegistrationError struct {
+	ServiceID string
+	Err       error
+}
+
+func (e *RegistrationError) Error() string {
+	return fmt.Sprintf("connect: unable to register service, %v: %v", e.ServiceID, e.Err)
+}
+
+func (e *RegistrationError) Unwrap() error {
+	return e.Err
+}
+
+// register registers the service with the agent.
+func (s *Service) register(ctx context.Context) error {
+	config := s.config
+	registration := consulapi.AgentServiceRegistration{
+		Kind:    config.kind,
+		ID:      config.id,
+		Name:    config.service,
+		Tags:    config.tags,
+		Meta:    config.meta,
+		Weights: config.weights,
+		Port:    config.port,
+		Address: config.address,
+		Check:   config.checks[0].registration(),
+	}
+	registration.Check.DeregisterCriticalServiceAfter = makeTTL(config.deregisterAfter)
+	for _, check := range config.checks[1:] {
+		registration.Checks = append(registration.Checks, check.registration())
+	}
+	registration.Checks = append(registration.Checks, config.nativeChecks...)
+	switch {
+	case config.kind == consulapi.ServiceKindConnectProxy:
+		registration.Proxy = config.proxy
+	case config.sidecar != nil:
+		registration.Connect = &consulapi.AgentServiceConnect{
+			SidecarService: config.sidecar.registration(config.service, config.address, config.port),
+		}
+	default:
+		registration.Connect = &consulapi.AgentServiceConnect{
 			Native: true,
-		},
+		}
 	}
 	if err := config.client.ServiceRegister(ctx, registration); err != nil {
 		return err
 	}
-	defer config.client.ServiceDeregister(context.Background(), serviceID)
 
-	ticker := time.NewTicker(config.healthCheckInterval)
+	s.registeredOnce.Do(func() { close(s.registered) })
+	s.emit(ServiceEvent{Kind: ServiceRegistered})
+
+	return nil
+}
+
+// update keeps check updated until ctx is done or the agent returns an
+// error.  The check is reported at once, rather than after its first
+// interval, since the agent registers ttl checks as critical.  updated
+// reports whether the agent accepted any update of the check.
+func (s *Service) update(ctx context.Context, check ttlCheck, primary bool) (updated bool, err error) {
+	ticker := time.NewTicker(check.interval)
 	defer ticker.Stop()
 
 	for {
+		status, output := check.runner.run(ctx)
+		if ctx.Err() != nil {
+			return updated, nil // stopped, rather than timed out, while checking
+		}
+
+		if err := s.config.client.UpdateTTL(ctx, status, check.id, output); err != nil {
+			if ctx.Err() != nil {
+				return updated, nil
+			}
+			return updated, err
+		}
+		updated = true
+		s.setStatus(check.id, primary, status, output)
+
 		select {
 		case <-ctx.Done():
-			return nil
-
+			return updated, nil
 		case <-ticker.C:
-			status := consulapi.StatusPass
-			output := "ok"
-			if err := config.healthCheckFunc(); err != nil {
-				status = consulapi.StatusFail
-				output = err.Error()
-			}
+		}
+	}
+}
 
-			if err := config.client.UpdateTTL(ctx, status, checkID, output); err != nil {
-				return err
-			}
+// registerAndUpdate registers the service, unless skipRegister is set, and
+// keeps each of its ttl checks updated until ctx is done or the agent
+// returns an error.  updated reports whether the agent accepted an update of
+// any check, i.e. whether the service was known to the agent.
+func (s *Service) registerAndUpdate(ctx context.Context, skipRegister bool) (updated bool, err error) {
+	if !skipRegister {
+		if err := s.register(ctx); err != nil {
+			return false, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		updated bool
+		err     error
+	}
+
+	results := make(chan result, len(s.config.checks))
+	for i, check := range s.config.checks {
+		go func(check ttlCheck, primary bool) {
+			updated, err := s.update(ctx, check, primary)
+			results <- result{updated: updated, err: err}
+		}(check, i == 0)
+	}
+
+	// the first error stops the remaining checks
+	for range s.config.checks {
+		r := <-results
+		updated = updated || r.updated
+		if r.err != nil && err == nil {
+			err = r.err
+			cancel()
 		}
 	}
+
+	return updated, err
 }
 
-func registerLoop(ctx context.Context, config config) {
+// backoff returns the delay before the given retry, doubling from
+// minRetryInterval up to maxRetryInterval with jitter so that services do
+// not all return at once when an agent recovers.
+func backoff(attempt int) time.Duration {
+	d := maxRetryInterval
+	if attempt < 16 {
+		if v := minRetryInterval << uint(attempt); v < maxRetryInterval {
+			d = v
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// registerLoop keeps the service registered until ctx is done.  The service
+// is registered under the same ID throughout so that when the agent loses
+// the registration, e.g. because it restarted without its state, the
+// service is promptly registered again as itself.
+//
+// When registered is set, the service has already been registered and the
+// first pass goes straight to updating its check.
+func (s *Service) registerLoop(ctx context.Context, registered bool) {
+	var (
+		config  = s.config
+		logf    = s.options.logf
+		skip    = registered
+		attempt int
+	)
+
 	for {
-		select {
-		case <-ctx.Done():
+		updated, err := s.registerAndUpdate(ctx, skip)
+		skip = false
+		if updated {
+			attempt = 0
+		}
+		if ctx.Err() != nil {
 			return
-		default:
 		}
 
-		if err := registerAndUpdate(ctx, config); err != nil {
-			log.Println(err)
+		s.emit(ServiceEvent{Kind: ServiceError, Err: err})
+
+		// only a registration the agent accepted updates for and has since
+		// lost is retried at once; the agent rejecting the registration or
+		// never knowing its checks backs off like any other error
+		if updated && consulapi.IsUnknown(err) {
+			logf("connect: agent lost registration of service, %v; re-registering", config.id)
+			continue
 		}
 
+		delay := backoff(attempt)
+		attempt++
+		logf("connect: unable to register service, %v; retrying in %v - %v", config.id, delay.Round(time.Millisecond), err)
+
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(12 * time.Second):
-			log.Println("retrying ...")
+		case <-time.After(delay):
 		}
 	}
 }
 
-type Service struct {
-	cancel context.CancelFunc
-	done   chan struct{}
+// ID returns the ID the service is registered under.
+func (s *Service) ID() string {
+	return s.config.id
 }
 
-func (s *Service) Close() error {
+// Registered returns a channel that is closed once the service has first
+// been registered with the agent.
+func (s *Service) Registered() <-chan struct{} {
+	return s.registered
+}
+
+// Status returns the status and output of the primary check of the service
+// last reported to the agent.  The status is blank until the first check
+// update.
+func (s *Service) Status() (consulapi.Status, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.status, s.output
+}
+
+// deregister removes the service from the agent, waiting no longer than the
+// deregister timeout.
+func (s *Service) deregister() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.options.deregisterTimeout)
+	defer cancel()
+
+	if err := s.config.client.ServiceDeregister(ctx, s.config.id); err != nil {
+		s.options.logf("connect: unable to deregister service, %v - %v", s.config.id, err)
+		s.emit(ServiceEvent{Kind: ServiceError, Err: err})
+		return err
+	}
+
+	s.emit(ServiceEvent{Kind: ServiceDeregistered})
+	return nil
+}
+
+// drain marks the primary check of the service critical so clients stop
+// routing to it, then waits out the drain period or until ctx is done.
+func (s *Service) drain(ctx context.Context) error {
+	check := s.config.checks[0]
+
+	failCtx, cancel := context.WithTimeout(ctx, s.options.deregisterTimeout)
+	err := s.config.client.UpdateTTL(failCtx, consulapi.StatusFail, check.id, outputShutdown)
+	cancel()
+	if err != nil {
+		s.options.logf("connect: unable to fail check of service, %v - %v", s.config.id, err)
+	} else {
+		s.setStatus(check.id, true, consulapi.StatusFail, outputShutdown)
+	}
+
+	if !sleep(ctx, s.options.drainPeriod) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *Service) shutdown(ctx context.Context) error {
 	s.cancel()
 	<-s.done
-	return nil
+
+	select {
+	case <-s.registered:
+	default:
+		return nil // never registered
+	}
+
+	var drainErr error
+	if s.options.drainPeriod > 0 {
+		drainErr = s.drain(ctx)
+	}
+
+	// deregister even when ctx cut the drain short; the deregister timeout
+	// bounds the wait for a hung agent
+	if err := s.deregister(); err != nil {
+		return err
+	}
+	return drainErr
 }
 
-func NewService(agent AgentAPI, service string, port int, opts ...ServiceOption) (*Service, error) {
+// Shutdown stops updating the checks of the service and deregisters it.
+// With WithDrainPeriod, the service is first reported as critical and given
+// the drain period for clients to move elsewhere before it is deregistered;
+// when ctx is done before the drain period ends, the service is deregistered
+// at once and ctx.Err() returned.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+	})
+	return s.shutdownErr
+}
+
+// Close is Shutdown without a deadline.
+func (s *Service) Close() error {
+	return s.Shutdown(context.Background())
+}
+
+func startService(config config, options serviceOptions) (*Service, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Service{
+		config:     config,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		options:    options,
+		registered: make(chan struct{}),
+	}
+
+	var registered bool
+	if options.syncCtx != nil {
+		if err := s.register(options.syncCtx); err != nil {
+			cancel()
+			return nil, &RegistrationError{ServiceID: config.id, Err: err}
+		}
+		registered = true
+	}
+
+	go func() {
+		defer close(s.done)
+		s.registerLoop(ctx, registered)
+	}()
+
+	return s, nil
+}
+
+func makeServiceOptions(opts ...ServiceOption) serviceOptions {
 	options := serviceOptions{
-		healthCheckFunc:     func() error { return nil },
+		checker:             passing,
 		healthCheckInterval: defaultHealthCheckInterval,
+		deregisterTimeout:   defaultDeregisterTimeout,
+		logf:                log.Printf,
 	}
 	for _, opt := range opts {
 		opt(&options)
 	}
+	return options
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	done := make(chan struct{})
-
-	go func() {
-		defer close(done)
-
-		config := config{
-			service:             service,
-			port:                port,
-			healthCheckInterval: options.healthCheckInterval,
-			healthCheckFunc:     options.healthCheckFunc,
-			client:              agent,
-		}
-		registerLoop(ctx, config)
-	}()
+// NewService registers service, listening on port, with the consul agent as
+// a Connect Native service and keeps it registered until Close is called.
+// Registration happens in the background unless WithSyncRegistration is
+// given, in which case a *RegistrationError is returned when the first
+// registration fails.
+func NewService(agent AgentAPI, service string, port int, opts ...ServiceOption) (*Service, error) {
+	if service == "" {
+		return nil, errServiceName
+	}
 
-	return &Service{
-		cancel: cancel,
-		done:   done,
-	}, nil
+	options := makeServiceOptions(opts...)
+	config, err := makeConfig(agent, service, port, options)
+	if err != nil {
+		return nil, err
+	}
+	return startService(config, options)
 }
 
+// makeTTL formats d as a duration the agent accepts, e.g. 1.5s, without
+// losing any fraction of a second.
 func makeTTL(d time.Duration) string {
-	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	return d.String()
 }
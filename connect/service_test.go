@@ -0,0 +1,676 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/savaki/consulapi"
+)
+
+// AgentMock records the services registered with it.
+type AgentMock struct {
+	*CAMock
+	*AuthorizeMock
+
+	// register and updateTTL, when set, provide the results of
+	// ServiceRegister and UpdateTTL
+	register   func(registration consulapi.AgentServiceRegistration) error
+	updateTTL  func(checkID string) error
+	deregister func(ctx context.Context) error
+
+	mutex         sync.Mutex
+	registrations []consulapi.AgentServiceRegistration
+	statuses      []consulapi.Status
+	deregistered  []string
+}
+
+func (m *AgentMock) ServiceRegister(ctx context.Context, registration consulapi.AgentServiceRegistration) error {
+	if m.register != nil {
+		if err := m.register(registration); err != nil {
+			return err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.registrations = append(m.registrations, registration)
+	return nil
+}
+
+func (m *AgentMock) ServiceDeregister(ctx context.Context, serviceID string) error {
+	if m.deregister != nil {
+		if err := m.deregister(ctx); err != nil {
+			return err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.deregistered = append(m.deregistered, serviceID)
+	return nil
+}
+
+func (m *AgentMock) UpdateTTL(ctx context.Context, status consulapi.Status, checkID, output string) error {
+	if m.updateTTL != nil {
+		if err := m.updateTTL(checkID); err != nil {
+			return err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.statuses = append(m.statuses, status)
+	return nil
+}
+
+func (m *AgentMock) Registrations() []consulapi.AgentServiceRegistration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]consulapi.AgentServiceRegistration(nil), m.registrations...)
+}
+
+func TestService_Reregister(t *testing.T) {
+	var (
+		mutex sync.Mutex
+		calls int
+	)
+	agent := &AgentMock{
+		updateTTL: func(checkID string) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			calls++
+			if calls == 2 {
+				return &consulapi.AgentError{StatusCode: http.StatusNotFound, Message: "Unknown check ID"}
+			}
+			return nil
+		},
+	}
+
+	service, err := NewService(agent, "web", 8080, WithHealthCheckInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	// the agent lost the check after accepting an update; the service
+	// registers again without waiting out a retry interval
+	var registrations []consulapi.AgentServiceRegistration
+	for deadline := time.Now().Add(minRetryInterval / 2); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if registrations = agent.Registrations(); len(registrations) >= 2 {
+			break
+		}
+	}
+	service.Close()
+
+	if got, want := len(registrations), 2; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := registrations[1].ID, registrations[0].ID; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := registrations[1].Check.CheckID, registrations[0].Check.CheckID; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := agent.deregistered, []string{registrations[0].ID}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestService_Outage(t *testing.T) {
+	agent := &AgentMock{
+		updateTTL: func(checkID string) error {
+			return errors.New("connection refused")
+		},
+	}
+
+	service, err := NewService(agent, "web", 8080, WithHealthCheckInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	// genuine errors back off before registering again
+	time.Sleep(minRetryInterval / 4)
+	service.Close()
+
+	if got, want := len(agent.Registrations()), 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestService_UpdateNotFound(t *testing.T) {
+	agent := &AgentMock{
+		updateTTL: func(checkID string) error {
+			return &consulapi.AgentError{StatusCode: http.StatusNotFound, Message: "404 page not found"}
+		},
+	}
+
+	service, err := NewService(agent, "web", 8080, WithHealthCheckInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	// no update was ever accepted, so the service backs off rather than
+	// registering and updating in a tight loop
+	time.Sleep(minRetryInterval / 4)
+	service.Close()
+
+	if got, want := len(agent.Registrations()), 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestService_RegisterNotFound(t *testing.T) {
+	var (
+		mutex sync.Mutex
+		calls int
+	)
+	agent := &AgentMock{
+		register: func(registration consulapi.AgentServiceRegistration) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			calls++
+			return &consulapi.AgentError{StatusCode: http.StatusNotFound, Message: "Unknown service"}
+		},
+	}
+
+	service, err := NewService(agent, "web", 8080, WithHealthCheckInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	// a rejected registration backs off rather than retrying at once
+	time.Sleep(minRetryInterval / 4)
+	service.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if got, want := calls, 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	testCases := map[int]time.Duration{
+		0:  minRetryInterval,
+		1:  2 * minRetryInterval,
+		3:  8 * minRetryInterval,
+		10: maxRetryInterval,
+		70: maxRetryInterval,
+	}
+
+	for attempt, max := range testCases {
+		for i := 0; i < 100; i++ {
+			if d := backoff(attempt); d < max/2 || d > max {
+				t.Fatalf("got %v; want between %v and %v", d, max/2, max)
+			}
+		}
+	}
+}
+
+func waitForRegistrations(t *testing.T, agent *AgentMock, n int) []consulapi.AgentServiceRegistration {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if registrations := agent.Registrations(); len(registrations) >= n {
+			return registrations
+		}
+	}
+	t.Fatalf("timed out waiting for %v registrations", n)
+	return nil
+}
+
+func TestService_Options(t *testing.T) {
+	agent := &AgentMock{}
+	service, err := NewService(agent, "web", 8080,
+		WithServiceID("web-1"),
+		WithServiceTags("v1", "blue"),
+		WithMeta("version", "1.2.3"),
+		WithAddress("10.0.0.1"),
+		WithWeights(10, 1),
+		WithCheckTTL(time.Minute),
+		WithDeregisterAfter(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	registration := waitForRegistrations(t, agent, 1)[0]
+	service.Close()
+
+	want := consulapi.AgentServiceRegistration{
+		ID:      "web-1",
+		Name:    "web",
+		Tags:    []string{"v1", "blue"},
+		Meta:    map[string]string{"version": "1.2.3"},
+		Weights: &consulapi.AgentWeights{Passing: 10, Warning: 1},
+		Port:    8080,
+		Address: "10.0.0.1",
+		Check: &consulapi.AgentServiceCheck{
+			CheckID:                        "service:web-1",
+			TTL:                            "1m0s",
+			DeregisterCriticalServiceAfter: "1h0m0s",
+		},
+		Connect: &consulapi.AgentServiceConnect{Native: true},
+	}
+	if !reflect.DeepEqual(registration, want) {
+		t.Fatalf("got %#v; want %#v", registration, want)
+	}
+}
+
+func TestMakeTTL(t *testing.T) {
+	testCases := map[time.Duration]string{
+		10 * time.Millisecond:   "10ms",
+		1500 * time.Millisecond: "1.5s",
+		time.Minute:             "1m0s",
+	}
+
+	for d, want := range testCases {
+		if got := makeTTL(d); got != want {
+			t.Fatalf("got %v; want %v", got, want)
+		}
+	}
+}
+
+func TestService_DefaultID(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		agent := &AgentMock{}
+		service, err := NewService(agent, "web", 8080)
+		if err != nil {
+			t.Fatalf("got %v; want nil", err)
+		}
+		ids = append(ids, waitForRegistrations(t, agent, 1)[0].ID)
+		service.Close()
+	}
+
+	if got, want := ids, []string{"web-" + host + "-8080", "web-" + host + "-8080"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestService_Lifecycle(t *testing.T) {
+	var (
+		mutex  sync.Mutex
+		events []ServiceEvent
+		agent  = &AgentMock{}
+	)
+
+	service, err := NewService(agent, "web", 8080,
+		WithServiceID("web-1"),
+		WithHealthCheckInterval(10*time.Millisecond),
+		WithHealthCheckFunc(func() error { return errors.New("boom") }),
+		WithServiceLogger(t.Logf),
+		WithEventHandler(func(event ServiceEvent) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, event)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	if got, want := service.ID(), "web-1"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	select {
+	case <-service.Registered():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for registration")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if status, _ := service.Status(); status != "" {
+			break
+		}
+	}
+	status, output := service.Status()
+	if got, want := status, consulapi.StatusFail; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := output, "boom"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	service.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if got, want := events[0], (ServiceEvent{Kind: ServiceRegistered, ServiceID: "web-1"}); got != want {
+		t.Fatalf("got %#v; want %#v", got, want)
+	}
+	if got, want := events[1], (ServiceEvent{Kind: CheckUpdated, ServiceID: "web-1", CheckID: "service:web-1", Status: consulapi.StatusFail, Output: "boom"}); got != want {
+		t.Fatalf("got %#v; want %#v", got, want)
+	}
+	if got, want := events[len(events)-1].Kind, ServiceDeregistered; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestService_SyncRegistration(t *testing.T) {
+	agent := &AgentMock{}
+	service, err := NewService(agent, "web", 8080,
+		WithSyncRegistration(context.Background()),
+		WithHealthCheckInterval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer service.Close()
+
+	select {
+	case <-service.Registered():
+	default:
+		t.Fatalf("got unregistered; want registered")
+	}
+
+	// the background loop carries on with the check rather than registering
+	// the service again
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if status, _ := service.Status(); status != "" {
+			break
+		}
+	}
+	if got, want := len(agent.Registrations()), 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestService_SyncRegistrationError(t *testing.T) {
+	denied := &consulapi.AgentError{StatusCode: http.StatusForbidden, Message: "Permission denied"}
+	agent := &AgentMock{
+		register: func(registration consulapi.AgentServiceRegistration) error {
+			return denied
+		},
+	}
+
+	_, err := NewService(agent, "web", 8080,
+		WithServiceID("web-1"),
+		WithSyncRegistration(context.Background()),
+	)
+
+	var registrationErr *RegistrationError
+	if !errors.As(err, &registrationErr) {
+		t.Fatalf("got %v; want *RegistrationError", err)
+	}
+	if got, want := registrationErr.ServiceID, "web-1"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	var agentErr *consulapi.AgentError
+	if !errors.As(err, &agentErr) || agentErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("got %v; want %v", err, denied)
+	}
+}
+
+func TestService_MissingService(t *testing.T) {
+	if _, err := NewService(&AgentMock{}, "", 8080); err != errServiceName {
+		t.Fatalf("got %v; want %v", err, errServiceName)
+	}
+}
+
+func TestService_Checks(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		updates = map[string]int{}
+		agent   = &AgentMock{
+			updateTTL: func(checkID string) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				updates[checkID]++
+				return nil
+			},
+		}
+	)
+
+	service, err := NewService(agent, "web", 8080,
+		WithServiceID("web-1"),
+		WithHealthCheckInterval(10*time.Millisecond),
+		WithCheck(Check{
+			Name:    "database",
+			Notes:   "primary postgres",
+			TTL:     time.Minute,
+			Checker: fixed(consulapi.StatusPass, "ok"),
+		}),
+		WithCheck(Check{
+			ID:       "cache",
+			Name:     "cache",
+			Interval: time.Hour,
+			Checker:  fixed(consulapi.StatusWarn, "slow"),
+		}),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	registration := waitForRegistrations(t, agent, 1)[0]
+	want := []*consulapi.AgentServiceCheck{
+		{CheckID: "service:web-1:database", Name: "database", Notes: "primary postgres", TTL: "1m0s"},
+		{CheckID: "cache", Name: "cache", TTL: "3h0m0s"},
+	}
+	if got := registration.Checks; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := registration.Check.CheckID, "service:web-1"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	// each check is updated once registered and then on its own interval
+	time.Sleep(100 * time.Millisecond)
+	service.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if updates["service:web-1"] == 0 || updates["service:web-1:database"] == 0 {
+		t.Fatalf("got %v; want updates of service:web-1 and service:web-1:database", updates)
+	}
+	if got, want := updates["cache"], 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestService_InvalidChecks(t *testing.T) {
+	testCases := map[string][]ServiceOption{
+		"blank name": {
+			WithCheck(Check{}),
+		},
+		"same name": {
+			WithCheck(Check{Name: "database"}),
+			WithCheck(Check{Name: "database"}),
+		},
+		"primary": {
+			WithCheck(Check{ID: "service:web-1", Name: "database"}),
+		},
+		"grpc": {
+			WithCheck(Check{Name: "grpc"}),
+			WithGRPCCheck(time.Second, ""),
+			WithSidecar(0),
+		},
+	}
+
+	for label, opts := range testCases {
+		t.Run(label, func(t *testing.T) {
+			agent := &AgentMock{}
+			opts = append(opts, WithServiceID("web-1"))
+			if _, err := NewService(agent, "web", 8080, opts...); err == nil {
+				t.Fatalf("got nil; want error")
+			}
+			if got, want := len(agent.Registrations()), 0; got != want {
+				t.Fatalf("got %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestService_EventsSerialized(t *testing.T) {
+	var (
+		active  int32
+		overlap int32
+	)
+	handler := func(event ServiceEvent) {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.StoreInt32(&overlap, 1)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+	}
+
+	opts := []ServiceOption{
+		WithHealthCheckInterval(time.Millisecond),
+		WithEventHandler(handler),
+	}
+	for _, name := range []string{"database", "cache", "queue"} {
+		opts = append(opts, WithCheck(Check{Name: name}))
+	}
+
+	service, err := NewService(&AgentMock{}, "web", 8080, opts...)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	service.Close()
+
+	if atomic.LoadInt32(&overlap) != 0 {
+		t.Fatalf("got concurrent calls of the event handler; want serialized calls")
+	}
+}
+
+func TestService_Drain(t *testing.T) {
+	const drainPeriod = 50 * time.Millisecond
+
+	agent := &AgentMock{}
+	service, err := NewService(agent, "web", 8080,
+		WithHealthCheckInterval(time.Hour),
+		WithSyncRegistration(context.Background()),
+		WithDrainPeriod(drainPeriod),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	// the check is reported once registered
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if status, _ := service.Status(); status != "" {
+			break
+		}
+	}
+
+	started := time.Now()
+	if err := service.Close(); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if elapsed := time.Since(started); elapsed < drainPeriod {
+		t.Fatalf("got %v; want at least %v", elapsed, drainPeriod)
+	}
+
+	if got, want := agent.statuses, []consulapi.Status{consulapi.StatusPass, consulapi.StatusFail}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := len(agent.deregistered), 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if status, output := service.Status(); status != consulapi.StatusFail || output != outputShutdown {
+		t.Fatalf("got %v, %v; want %v, %v", status, output, consulapi.StatusFail, outputShutdown)
+	}
+
+	// subsequent calls return the result of the first
+	if err := service.Close(); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := len(agent.deregistered), 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestService_ShutdownDeadline(t *testing.T) {
+	agent := &AgentMock{}
+	service, err := NewService(agent, "web", 8080,
+		WithHealthCheckInterval(time.Hour),
+		WithSyncRegistration(context.Background()),
+		WithDrainPeriod(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := service.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v; want %v", err, context.DeadlineExceeded)
+	}
+	if got, want := len(agent.deregistered), 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestService_DeregisterTimeout(t *testing.T) {
+	agent := &AgentMock{
+		deregister: func(ctx context.Context) error {
+			<-ctx.Done() // a hung agent
+			return ctx.Err()
+		},
+	}
+	service, err := NewService(agent, "web", 8080,
+		WithHealthCheckInterval(time.Hour),
+		WithSyncRegistration(context.Background()),
+		WithDeregisterTimeout(20*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	if err := service.Close(); err != context.DeadlineExceeded {
+		t.Fatalf("got %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestService_Sidecar(t *testing.T) {
+	agent := &AgentMock{}
+	service, err := NewService(agent, "web", 8080,
+		WithServiceID("web-1"),
+		WithAddress("10.0.0.1"),
+		WithSidecar(21000,
+			Upstream{DestinationName: "db", LocalBindPort: 9191},
+			Upstream{DestinationName: "cache", Datacenter: "east", LocalBindPort: 9192},
+		),
+	)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	registration := waitForRegistrations(t, agent, 1)[0]
+	service.Close()
+
+	want := &consulapi.AgentServiceConnect{
+		SidecarService: &consulapi.AgentServiceRegistration{
+			Port: 21000,
+			Proxy: &consulapi.AgentServiceProxy{
+				DestinationServiceName: "web",
+				LocalServiceAddress:    "10.0.0.1",
+				LocalServicePort:       8080,
+				Upstreams: []consulapi.AgentServiceUpstream{
+					{DestinationType: "service", DestinationName: "db", LocalBindPort: 9191},
+					{DestinationType: "service", DestinationName: "cache", Datacenter: "east", LocalBindPort: 9192},
+				},
+			},
+		},
+	}
+	if got := registration.Connect; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v; want %#v", got, want)
+	}
+	if got, want := registration.Kind, consulapi.ServiceKindTypical; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
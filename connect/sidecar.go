@@ -0,0 +1,46 @@
+package connect
+
+import (
+	"github.com/savaki/consulapi"
+)
+
+type sidecar struct {
+	port      int
+	upstreams []Upstream
+}
+
+// registration returns the sidecar service registration of service,
+// listening on address:port.  The agent assumes 127.0.0.1 when address is
+// blank.
+func (s sidecar) registration(service, address string, port int) *consulapi.AgentServiceRegistration {
+	var upstreams []consulapi.AgentServiceUpstream
+	for _, upstream := range s.upstreams {
+		upstreams = append(upstreams, upstream.registration())
+	}
+
+	return &consulapi.AgentServiceRegistration{
+		Port: s.port,
+		Proxy: &consulapi.AgentServiceProxy{
+			DestinationServiceName: service,
+			LocalServiceAddress:    address,
+			LocalServicePort:       port,
+			Upstreams:              upstreams,
+		},
+	}
+}
+
+// WithSidecar registers the service with a sidecar proxy, rather than as a
+// Connect Native service, for services that do not yet terminate connect
+// tls themselves.  The sidecar listens on port, or a port chosen by the
+// agent when port is 0, and binds a local port for each upstream.  The
+// proxy itself, e.g. envoy started with `consul connect envoy -sidecar-for`,
+// is run separately; the sidecar registration is removed along with the
+// service.
+func WithSidecar(port int, upstreams ...Upstream) ServiceOption {
+	return func(o *serviceOptions) {
+		o.sidecar = &sidecar{
+			port:      port,
+			upstreams: upstreams,
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Package spiffe parses and formats the SPIFFE identities that consul
+// connect encodes in the URI SAN of its certificates.
+//
+//	spiffe://<trust domain>/ns/<namespace>/dc/<datacenter>/svc/<service>
+//	spiffe://<trust domain>/agent/client/dc/<datacenter>/id/<node>
+package spiffe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const scheme = "spiffe"
+
+var (
+	ErrInvalidID     = errors.New("spiffe: not a consul connect identity")
+	ErrNoCertificate = errors.New("spiffe: connection has no peer certificate")
+	ErrNoServiceID   = errors.New("spiffe: certificate does not contain a connect service identity")
+	ErrTrustDomain   = errors.New("spiffe: identity belongs to a different trust domain")
+)
+
+// ID is a consul connect identity, either a ServiceID or an AgentID.
+type ID interface {
+	// URI returns the spiffe uri of the identity
+	URI() *url.URL
+	// Domain returns the trust domain of the identity
+	Domain() string
+}
+
+// ServiceID identifies a connect service.
+type ServiceID struct {
+	TrustDomain string
+	Namespace   string
+	Datacenter  string
+	Service     string
+}
+
+func (id ServiceID) URI() *url.URL {
+	return &url.URL{
+		Scheme: scheme,
+		Host:   id.TrustDomain,
+		Path:   fmt.Sprintf("/ns/%s/dc/%s/svc/%s", id.Namespace, id.Datacenter, id.Service),
+	}
+}
+
+func (id ServiceID) Domain() string {
+	return id.TrustDomain
+}
+
+func (id ServiceID) String() string {
+	return id.URI().String()
+}
+
+// AgentID identifies a consul client agent.
+type AgentID struct {
+	TrustDomain string
+	Datacenter  string
+	Agent       string
+}
+
+func (id AgentID) URI() *url.URL {
+	return &url.URL{
+		Scheme: scheme,
+		Host:   id.TrustDomain,
+		Path:   fmt.Sprintf("/agent/client/dc/%s/id/%s", id.Datacenter, id.Agent),
+	}
+}
+
+func (id AgentID) Domain() string {
+	return id.TrustDomain
+}
+
+func (id AgentID) String() string {
+	return id.URI().String()
+}
+
+// Parse returns the identity encoded in uri.
+func Parse(uri *url.URL) (ID, error) {
+	if uri == nil || uri.Scheme != scheme || uri.Host == "" {
+		return nil, ErrInvalidID
+	}
+
+	segments := strings.Split(strings.TrimPrefix(uri.Path, "/"), "/")
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, ErrInvalidID
+		}
+	}
+
+	switch {
+	case len(segments) == 6 && segments[0] == "ns" && segments[2] == "dc" && segments[4] == "svc":
+		return ServiceID{
+			TrustDomain: uri.Host,
+			Namespace:   segments[1],
+			Datacenter:  segments[3],
+			Service:     segments[5],
+		}, nil
+
+	case len(segments) == 6 && segments[0] == "agent" && segments[1] == "client" && segments[2] == "dc" && segments[4] == "id":
+		return AgentID{
+			TrustDomain: uri.Host,
+			Datacenter:  segments[3],
+			Agent:       segments[5],
+		}, nil
+	}
+
+	return nil, ErrInvalidID
+}
+
+// ParseString returns the identity encoded in the uri s.
+func ParseString(s string) (ID, error) {
+	uri, err := url.Parse(s)
+	if err != nil {
+		return nil, ErrInvalidID
+	}
+	return Parse(uri)
+}
+
+// ParseServiceID returns the service identity encoded in uri.
+func ParseServiceID(uri *url.URL) (ServiceID, error) {
+	id, err := Parse(uri)
+	if err != nil {
+		return ServiceID{}, err
+	}
+	serviceID, ok := id.(ServiceID)
+	if !ok {
+		return ServiceID{}, ErrInvalidID
+	}
+	return serviceID, nil
+}
+
+// ValidateTrustDomain verifies that id belongs to trustDomain, the
+// TrustDomain of the CA roots of the consul agent.
+func ValidateTrustDomain(id ID, trustDomain string) error {
+	if !strings.EqualFold(id.Domain(), trustDomain) {
+		return ErrTrustDomain
+	}
+	return nil
+}
+
+// FromCertificate returns the service identity of cert.
+func FromCertificate(cert *x509.Certificate) (ServiceID, error) {
+	for _, uri := range cert.URIs {
+		if id, err := ParseServiceID(uri); err == nil {
+			return id, nil
+		}
+	}
+	return ServiceID{}, ErrNoServiceID
+}
+
+// FromConnectionState returns the service identity of the peer of a tls
+// connection.
+func FromConnectionState(state tls.ConnectionState) (ServiceID, error) {
+	if len(state.PeerCertificates) == 0 {
+		return ServiceID{}, ErrNoCertificate
+	}
+	return FromCertificate(state.PeerCertificates[0])
+}
@@ -0,0 +1,93 @@
+package spiffe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+	"testing"
+)
+
+const trustDomain = "11111111-2222-3333-4444-555555555555.consul"
+
+func TestParseString(t *testing.T) {
+	testCases := map[string]struct {
+		URI  string
+		Want ID
+		Err  error
+	}{
+		"service": {
+			URI:  "spiffe://" + trustDomain + "/ns/default/dc/dc1/svc/web",
+			Want: ServiceID{TrustDomain: trustDomain, Namespace: "default", Datacenter: "dc1", Service: "web"},
+		},
+		"agent": {
+			URI:  "spiffe://" + trustDomain + "/agent/client/dc/dc1/id/node-1",
+			Want: AgentID{TrustDomain: trustDomain, Datacenter: "dc1", Agent: "node-1"},
+		},
+		"scheme":  {URI: "https://" + trustDomain + "/ns/default/dc/dc1/svc/web", Err: ErrInvalidID},
+		"domain":  {URI: "spiffe:///ns/default/dc/dc1/svc/web", Err: ErrInvalidID},
+		"short":   {URI: "spiffe://" + trustDomain + "/ns/default/dc/dc1", Err: ErrInvalidID},
+		"blank":   {URI: "spiffe://" + trustDomain + "/ns//dc/dc1/svc/web", Err: ErrInvalidID},
+		"unknown": {URI: "spiffe://" + trustDomain + "/foo/default/dc/dc1/svc/web", Err: ErrInvalidID},
+	}
+
+	for label, tc := range testCases {
+		t.Run(label, func(t *testing.T) {
+			id, err := ParseString(tc.URI)
+			if err != tc.Err {
+				t.Fatalf("got %v; want %v", err, tc.Err)
+			}
+			if err != nil {
+				return
+			}
+			if id != tc.Want {
+				t.Fatalf("got %#v; want %#v", id, tc.Want)
+			}
+			if got, want := id.URI().String(), tc.URI; got != want {
+				t.Fatalf("got %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseServiceID(t *testing.T) {
+	uri := AgentID{TrustDomain: trustDomain, Datacenter: "dc1", Agent: "node-1"}.URI()
+	if _, err := ParseServiceID(uri); err != ErrInvalidID {
+		t.Fatalf("got %v; want %v", err, ErrInvalidID)
+	}
+}
+
+func TestValidateTrustDomain(t *testing.T) {
+	id := ServiceID{TrustDomain: trustDomain, Namespace: "default", Datacenter: "dc1", Service: "web"}
+
+	if err := ValidateTrustDomain(id, "11111111-2222-3333-4444-555555555555.CONSUL"); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if err := ValidateTrustDomain(id, "other.consul"); err != ErrTrustDomain {
+		t.Fatalf("got %v; want %v", err, ErrTrustDomain)
+	}
+}
+
+func TestFromConnectionState(t *testing.T) {
+	want := ServiceID{TrustDomain: trustDomain, Namespace: "default", Datacenter: "dc1", Service: "web"}
+	cert := &x509.Certificate{
+		URIs: []*url.URL{
+			{Scheme: "https", Host: "example.com"},
+			want.URI(),
+		},
+	}
+
+	id, err := FromConnectionState(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if id != want {
+		t.Fatalf("got %#v; want %#v", id, want)
+	}
+
+	if _, err := FromConnectionState(tls.ConnectionState{}); err != ErrNoCertificate {
+		t.Fatalf("got %v; want %v", err, ErrNoCertificate)
+	}
+	if _, err := FromCertificate(&x509.Certificate{}); err != ErrNoServiceID {
+		t.Fatalf("got %v; want %v", err, ErrNoServiceID)
+	}
+}
@@ -0,0 +1,236 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/savaki/consulapi"
+	"github.com/savaki/consulapi/connect/spiffe"
+)
+
+var (
+	errInvalidRoot      = errors.New("connect: unable to parse CA root certificate")
+	errNoCertificates   = errors.New("connect: peer presented no certificates")
+	errNoServiceID      = spiffe.ErrNoServiceID
+	errTrustDomain      = spiffe.ErrTrustDomain
+	errUnexpectedTarget = errors.New("connect: certificate does not identify the target service")
+)
+
+// CAAPI provides the connect certificates of the consul agent.
+type CAAPI interface {
+	ConnectCALeafQuery(ctx context.Context, input consulapi.AgentConnectCALeafRequest) (consulapi.AgentConnectCALeaf, error)
+	ConnectCARootsQuery(ctx context.Context, input consulapi.AgentConnectCARootsRequest) (consulapi.AgentConnectCARoots, error)
+}
+
+type tlsState struct {
+	leaf          consulapi.AgentConnectCALeaf
+	roots         consulapi.AgentConnectCARoots
+	cert          tls.Certificate
+	rootPool      *x509.CertPool
+	intermediates []*x509.Certificate
+	trustDomain   string
+}
+
+func newTLSState(leaf consulapi.AgentConnectCALeaf, roots consulapi.AgentConnectCARoots) (*tlsState, error) {
+	cert, err := tls.X509KeyPair([]byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("connect: unable to parse leaf certificate for service, %v: %v", leaf.Service, err)
+	}
+
+	var intermediates []*x509.Certificate
+	rootPool := x509.NewCertPool()
+	for _, root := range roots.Roots {
+		if !rootPool.AppendCertsFromPEM([]byte(root.RootCert)) {
+			return nil, errInvalidRoot
+		}
+		for _, data := range root.IntermediateCerts {
+			block, _ := pem.Decode([]byte(data))
+			if block == nil {
+				return nil, errInvalidRoot
+			}
+			intermediate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			intermediates = append(intermediates, intermediate)
+		}
+	}
+
+	return &tlsState{
+		leaf:          leaf,
+		roots:         roots,
+		cert:          cert,
+		rootPool:      rootPool,
+		intermediates: intermediates,
+		trustDomain:   roots.TrustDomain,
+	}, nil
+}
+
+// TLSSource provides the tls configuration of a Connect Native service from
+// the leaf certificate of the service and the CA roots of the consul agent.
+// Both are watched in the background and replaced as they are renewed or
+// rotated; tls configurations obtained from the source pick up the
+// replacements for new handshakes.
+type TLSSource struct {
+	service string
+	agent   CAAPI
+	options tlsOptions
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mutex sync.Mutex   // serializes updates to state
+	state atomic.Value // *tlsState
+}
+
+func (s *TLSSource) load() *tlsState {
+	return s.state.Load().(*tlsState)
+}
+
+func (s *TLSSource) getCertificate() *tls.Certificate {
+	state := s.load()
+	return &state.cert
+}
+
+// Service returns the name of the service the certificates belong to.
+func (s *TLSSource) Service() string {
+	return s.service
+}
+
+// verifyPeer verifies the certificates presented by a peer against the
+// connect CA roots and returns the service ID of the leaf.  When service is
+// not blank, the leaf must identify that service.
+func (s *TLSSource) verifyPeer(rawCerts [][]byte, service string) (spiffe.ServiceID, error) {
+	if len(rawCerts) == 0 {
+		return spiffe.ServiceID{}, errNoCertificates
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return spiffe.ServiceID{}, err
+		}
+		certs = append(certs, cert)
+	}
+
+	state := s.load()
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.intermediates {
+		intermediates.AddCert(cert)
+	}
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         state.rootPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return spiffe.ServiceID{}, err
+	}
+
+	id, err := spiffe.FromCertificate(certs[0])
+	if err != nil {
+		return spiffe.ServiceID{}, err
+	}
+	if err := spiffe.ValidateTrustDomain(id, state.trustDomain); err != nil {
+		return spiffe.ServiceID{}, err
+	}
+	if service != "" && id.Service != service {
+		return spiffe.ServiceID{}, errUnexpectedTarget
+	}
+
+	return id, nil
+}
+
+// ServerTLSConfig returns the tls configuration of the service when accepting
+// connections.  Clients must present a certificate issued by the connect CA;
+// whether they may connect is a matter for intentions.
+func (s *TLSSource) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.getCertificate(), nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := s.verifyPeer(rawCerts, "")
+			return err
+		},
+	}
+}
+
+// ClientTLSConfig returns the tls configuration of the service when
+// connecting to target.  The server must present a certificate issued by
+// the connect CA that identifies target.
+func (s *TLSSource) ClientTLSConfig(target string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// connect certificates carry no DNS names; the server is instead
+		// verified by VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return s.getCertificate(), nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := s.verifyPeer(rawCerts, target)
+			return err
+		},
+	}
+}
+
+// Close stops watching for new certificates.
+func (s *TLSSource) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// NewTLSSource fetches the leaf certificate of service and the CA roots from
+// the consul agent and watches them for changes until Close is called.
+func NewTLSSource(ctx context.Context, agent CAAPI, service string, opts ...TLSOption) (*TLSSource, error) {
+	options := tlsOptions{
+		logf:        func(format string, args ...interface{}) {},
+		minInterval: defaultMinInterval,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	leaf, err := agent.ConnectCALeafQuery(ctx, consulapi.AgentConnectCALeafRequest{Service: service})
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := agent.ConnectCARootsQuery(ctx, consulapi.AgentConnectCARootsRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := newTLSState(leaf, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	source := &TLSSource{
+		service: service,
+		agent:   agent,
+		options: options,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	source.state.Store(state)
+
+	go source.watch(watchCtx)
+
+	return source, nil
+}
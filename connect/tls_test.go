@@ -0,0 +1,361 @@
+package connect
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/savaki/consulapi"
+	"github.com/savaki/consulapi/connect/spiffe"
+)
+
+const testTrustDomain = "11111111-2222-3333-4444-555555555555.consul"
+
+// TestCA issues connect style certificates for tests.
+type TestCA struct {
+	t           *testing.T
+	trustDomain string
+	key         *ecdsa.PrivateKey
+	cert        *x509.Certificate
+	certPEM     string
+
+	mutex  sync.Mutex
+	serial int64
+}
+
+func NewTestCA(t *testing.T, trustDomain string) *TestCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: trustDomain}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	return &TestCA{
+		t:           t,
+		trustDomain: trustDomain,
+		key:         key,
+		cert:        cert,
+		certPEM:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		serial:      1,
+	}
+}
+
+func (ca *TestCA) Roots() consulapi.AgentConnectCARoots {
+	return consulapi.AgentConnectCARoots{
+		ActiveRootID: "root",
+		TrustDomain:  ca.trustDomain,
+		Roots: []consulapi.AgentConnectCARoot{
+			{ID: "root", RootCert: ca.certPEM, Active: true},
+		},
+	}
+}
+
+func (ca *TestCA) Leaf(service string, validFor time.Duration) consulapi.AgentConnectCALeaf {
+	return ca.issue(ca.trustDomain, service, validFor)
+}
+
+func (ca *TestCA) issue(trustDomain, service string, validFor time.Duration) consulapi.AgentConnectCALeaf {
+	ca.mutex.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.mutex.Unlock()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatalf("got %v; want nil", err)
+	}
+
+	uri := &url.URL{Scheme: "spiffe", Host: trustDomain, Path: "/ns/default/dc/dc1/svc/" + service}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: service},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{uri},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatalf("got %v; want nil", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatalf("got %v; want nil", err)
+	}
+
+	return consulapi.AgentConnectCALeaf{
+		SerialNumber:  big.NewInt(serial).Text(16),
+		CertPEM:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		Service:       service,
+		ServiceURI:    uri.String(),
+		ValidAfter:    template.NotBefore,
+		ValidBefore:   template.NotAfter,
+	}
+}
+
+// CAMock serves the certificates of a TestCA as a consul agent would,
+// including blocking queries.
+type CAMock struct {
+	CA *TestCA
+
+	mutex   sync.Mutex
+	index   int64
+	leaves  map[string]consulapi.AgentConnectCALeaf
+	roots   consulapi.AgentConnectCARoots
+	changed chan struct{}
+	inputs  []consulapi.AgentConnectCALeafRequest
+}
+
+func NewCAMock(ca *TestCA) *CAMock {
+	m := &CAMock{
+		CA:      ca,
+		leaves:  map[string]consulapi.AgentConnectCALeaf{},
+		changed: make(chan struct{}),
+	}
+	m.index++
+	m.roots = ca.Roots()
+	m.roots.Index = m.index
+	return m
+}
+
+// notify wakes blocked queries; the mutex must be held.
+func (m *CAMock) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// Rotate issues a new leaf certificate for service.
+func (m *CAMock) Rotate(service string, validFor time.Duration) consulapi.AgentConnectCALeaf {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.index++
+	leaf := m.CA.Leaf(service, validFor)
+	leaf.ModifyIndex = m.index
+	m.leaves[service] = leaf
+	m.notify()
+	return leaf
+}
+
+// RotateRoots replaces the CA.
+func (m *CAMock) RotateRoots(ca *TestCA, activeRootID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.index++
+	m.CA = ca
+	m.roots = ca.Roots()
+	m.roots.ActiveRootID = activeRootID
+	m.roots.Index = m.index
+	m.notify()
+}
+
+func (m *CAMock) Inputs() []consulapi.AgentConnectCALeafRequest {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]consulapi.AgentConnectCALeafRequest(nil), m.inputs...)
+}
+
+func (m *CAMock) block(ctx context.Context, changed chan struct{}, wait time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-changed:
+	case <-time.After(wait):
+	}
+	return nil
+}
+
+func (m *CAMock) ConnectCALeafQuery(ctx context.Context, input consulapi.AgentConnectCALeafRequest) (consulapi.AgentConnectCALeaf, error) {
+	m.mutex.Lock()
+	m.inputs = append(m.inputs, input)
+	m.mutex.Unlock()
+
+	for {
+		m.mutex.Lock()
+		leaf, ok := m.leaves[input.Service]
+		if !ok {
+			m.index++
+			leaf = m.CA.Leaf(input.Service, time.Hour)
+			leaf.ModifyIndex = m.index
+			m.leaves[input.Service] = leaf
+		}
+		changed := m.changed
+		m.mutex.Unlock()
+
+		if input.WaitIndex == 0 || leaf.ModifyIndex > input.WaitIndex {
+			return leaf, nil
+		}
+		if err := m.block(ctx, changed, input.WaitTime); err != nil {
+			return consulapi.AgentConnectCALeaf{}, err
+		}
+		input.WaitIndex = 0
+	}
+}
+
+func (m *CAMock) ConnectCARootsQuery(ctx context.Context, input consulapi.AgentConnectCARootsRequest) (consulapi.AgentConnectCARoots, error) {
+	for {
+		m.mutex.Lock()
+		roots, changed := m.roots, m.changed
+		m.mutex.Unlock()
+
+		if input.WaitIndex == 0 || roots.Index > input.WaitIndex {
+			return roots, nil
+		}
+		if err := m.block(ctx, changed, input.WaitTime); err != nil {
+			return consulapi.AgentConnectCARoots{}, err
+		}
+		input.WaitIndex = 0
+	}
+}
+
+func newTestTLSSource(t *testing.T, ca *TestCA, service string) *TLSSource {
+	source, err := NewTLSSource(context.Background(), NewCAMock(ca), service)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	t.Cleanup(func() { source.Close() })
+	return source
+}
+
+// handshake performs a tls handshake between the two configs and returns the
+// errors observed by the server and client respectively.  A loopback tcp
+// connection is used rather than net.Pipe as the latter deadlocks when the
+// server sends an alert while the client is writing.
+func handshake(server, client *tls.Config) (serverErr, clientErr error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err, err
+	}
+	defer listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serverConn, err := listener.Accept()
+		if err != nil {
+			serverErr = err
+			return
+		}
+		conn := tls.Server(serverConn, server)
+		serverErr = conn.Handshake()
+		conn.Close()
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err, err
+	}
+	conn := tls.Client(clientConn, client)
+	clientErr = conn.Handshake()
+	if clientErr == nil {
+		// tls 1.3 clients complete the handshake before the server verifies
+		// the client certificate; a clean close by the server reads as EOF
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			clientErr = err
+		}
+	}
+	conn.Close()
+	<-done
+
+	return serverErr, clientErr
+}
+
+func TestTLSSource(t *testing.T) {
+	ca := NewTestCA(t, testTrustDomain)
+	server := newTestTLSSource(t, ca, "db")
+	client := newTestTLSSource(t, ca, "web")
+
+	serverErr, clientErr := handshake(server.ServerTLSConfig(), client.ClientTLSConfig("db"))
+	if serverErr != nil {
+		t.Fatalf("got %v; want nil", serverErr)
+	}
+	if clientErr != nil {
+		t.Fatalf("got %v; want nil", clientErr)
+	}
+}
+
+func TestTLSSource_WrongTarget(t *testing.T) {
+	ca := NewTestCA(t, testTrustDomain)
+	server := newTestTLSSource(t, ca, "cache")
+	client := newTestTLSSource(t, ca, "web")
+
+	_, clientErr := handshake(server.ServerTLSConfig(), client.ClientTLSConfig("db"))
+	if clientErr == nil {
+		t.Fatalf("got nil; want error")
+	}
+}
+
+func TestTLSSource_UntrustedClient(t *testing.T) {
+	server := newTestTLSSource(t, NewTestCA(t, testTrustDomain), "db")
+	client := newTestTLSSource(t, NewTestCA(t, testTrustDomain), "web")
+
+	serverErr, _ := handshake(server.ServerTLSConfig(), client.ClientTLSConfig("db"))
+	if serverErr == nil {
+		t.Fatalf("got nil; want error")
+	}
+}
+
+func TestTLSSource_VerifyPeer(t *testing.T) {
+	ca := NewTestCA(t, testTrustDomain)
+	source := newTestTLSSource(t, ca, "web")
+
+	parse := func(leaf consulapi.AgentConnectCALeaf) [][]byte {
+		block, _ := pem.Decode([]byte(leaf.CertPEM))
+		return [][]byte{block.Bytes}
+	}
+
+	id, err := source.verifyPeer(parse(ca.Leaf("db", time.Hour)), "db")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	want := spiffe.ServiceID{TrustDomain: testTrustDomain, Namespace: "default", Datacenter: "dc1", Service: "db"}
+	if id != want {
+		t.Fatalf("got %#v; want %#v", id, want)
+	}
+
+	if _, err := source.verifyPeer(parse(ca.Leaf("cache", time.Hour)), "db"); err != errUnexpectedTarget {
+		t.Fatalf("got %v; want %v", err, errUnexpectedTarget)
+	}
+
+	// signed by the CA, but for a different trust domain
+	if _, err := source.verifyPeer(parse(ca.issue("other.consul", "db", time.Hour)), "db"); err != errTrustDomain {
+		t.Fatalf("got %v; want %v", err, errTrustDomain)
+	}
+
+	if _, err := source.verifyPeer(nil, "db"); err != errNoCertificates {
+		t.Fatalf("got %v; want %v", err, errNoCertificates)
+	}
+}
@@ -0,0 +1,181 @@
+package connect
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/savaki/consulapi"
+)
+
+const (
+	retryInterval = 15 * time.Second
+
+	// failoverWaitTime bounds the blocking queries against the local
+	// datacenter while failed over so changes in the failover datacenter are
+	// also noticed.
+	failoverWaitTime = 15 * time.Second
+)
+
+// blockingTimeout returns the timeout of a blocking query with the given
+// wait; consul adds up to wait/16 of jitter.
+func blockingTimeout(wait time.Duration) time.Duration {
+	return wait + wait/16 + 30*time.Second
+}
+
+type datacenterIndex struct {
+	datacenter string
+	index      int64
+}
+
+// healthWatch follows the healthy instances of a service using consul
+// blocking queries.  When the local datacenter has no healthy instances, the
+// failover datacenters are consulted in order.
+type healthWatch struct {
+	client      HealthQueryAPI
+	input       consulapi.HealthConnectRequest
+	waitTime    time.Duration
+	minInterval time.Duration
+	nearest     int
+	logf        func(format string, args ...interface{})
+
+	datacenters []*datacenterIndex
+	failover    bool
+	last        time.Time
+	current     map[string]*Instance
+	started     bool
+}
+
+func newHealthWatch(client HealthQueryAPI, input consulapi.HealthConnectRequest, options resolverOptions) *healthWatch {
+	datacenters := []*datacenterIndex{{datacenter: input.Datacenter}}
+	for _, dc := range options.failoverDatacenters {
+		datacenters = append(datacenters, &datacenterIndex{datacenter: dc})
+	}
+
+	return &healthWatch{
+		client:      client,
+		input:       input,
+		waitTime:    options.waitTime,
+		minInterval: options.minInterval,
+		nearest:     options.nearest,
+		logf:        options.logf,
+		datacenters: datacenters,
+	}
+}
+
+// throttle waits until at least minInterval has passed since the previous
+// query.
+func (w *healthWatch) throttle(ctx context.Context) error {
+	delay := w.minInterval - time.Since(w.last)
+	if w.last.IsZero() || delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// queryDatacenter returns the instances of the service in the datacenter of
+// target, blocking for up to wait when wait is positive.
+func (w *healthWatch) queryDatacenter(ctx context.Context, target *datacenterIndex, wait time.Duration) ([]consulapi.HealthServiceEntry, error) {
+	input := w.input
+	input.Datacenter = target.datacenter
+	if wait > 0 {
+		input.WaitIndex = target.index
+		input.WaitTime = wait
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, blockingTimeout(wait))
+	defer cancel()
+
+	output, err := w.client.ConnectQuery(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if output.Index < target.index {
+		// the index went backwards, e.g. the agent was restarted; start over
+		// with a non-blocking query
+		target.index = 0
+	} else {
+		target.index = output.Index
+	}
+
+	entries := output.Entries
+	if w.nearest > 0 {
+		// entries are sorted by distance from the agent
+		if len(entries) > w.nearest {
+			entries = entries[:w.nearest]
+		}
+		return entries, nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Service.ID < entries[j].Service.ID })
+	return entries, nil
+}
+
+func (w *healthWatch) query(ctx context.Context) ([]consulapi.HealthServiceEntry, error) {
+	if err := w.throttle(ctx); err != nil {
+		return nil, err
+	}
+	w.last = time.Now()
+
+	wait := w.waitTime
+	if w.failover && wait > failoverWaitTime {
+		wait = failoverWaitTime
+	}
+
+	local := w.datacenters[0]
+	entries, err := w.queryDatacenter(ctx, local, wait)
+	if err != nil {
+		return nil, err
+	}
+
+	w.failover = len(entries) == 0 && len(w.datacenters) > 1
+	if !w.failover {
+		return entries, nil
+	}
+
+	for _, target := range w.datacenters[1:] {
+		failover, err := w.queryDatacenter(ctx, target, 0)
+		if err != nil {
+			w.logf("consul resolver: unable to query service, %v, in datacenter, %v - %v", w.input.Service, target.datacenter, err)
+			continue
+		}
+		if len(failover) > 0 {
+			return failover, nil
+		}
+	}
+
+	return entries, nil
+}
+
+// next blocks until the healthy instances of the service differ from those
+// returned by the previous call.  The first call returns immediately.
+// Changes that do not affect the resolved instances, such as the output of a
+// check, are ignored.
+func (w *healthWatch) next(ctx context.Context) ([]consulapi.HealthServiceEntry, error) {
+	for {
+		entries, err := w.query(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		latest := instancesByAddr(entries)
+		if w.started && reflect.DeepEqual(w.current, latest) {
+			continue
+		}
+
+		w.current = latest
+		w.started = true
+		return entries, nil
+	}
+}
@@ -0,0 +1,179 @@
+package connect
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/savaki/consulapi"
+	"google.golang.org/grpc/naming"
+)
+
+func TestHealthWatch(t *testing.T) {
+	a := consulapi.HealthServiceEntry{Service: consulapi.HealthService{ID: "a", Address: "10.0.0.1", Port: 1}}
+	b := consulapi.HealthServiceEntry{Service: consulapi.HealthService{ID: "b", Address: "10.0.0.2", Port: 1}}
+
+	m := &Mock{
+		entries: [][]consulapi.HealthServiceEntry{
+			{a},
+			{a}, // unchanged; skipped
+			{a, b},
+			{b},
+		},
+		indexes: []int64{10, 11, 12, 5},
+	}
+	options := makeResolverOptions(WithWaitTime(time.Minute), WithMinInterval(time.Millisecond))
+	w := newHealthWatch(m, consulapi.HealthConnectRequest{Service: "blah", Passing: true}, options)
+
+	ctx := context.Background()
+	for _, want := range [][]consulapi.HealthServiceEntry{{a}, {a, b}, {b}} {
+		got, err := w.next(ctx)
+		if err != nil {
+			t.Fatalf("got %v; want nil", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v; want %v", got, want)
+		}
+	}
+
+	var indexes []int64
+	for _, input := range m.inputs {
+		indexes = append(indexes, input.WaitIndex)
+		if got, want := input.WaitTime, time.Minute; got != want {
+			t.Fatalf("got %v; want %v", got, want)
+		}
+	}
+	if got, want := indexes, []int64{0, 10, 11, 12}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := w.datacenters[0].index, int64(0); got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestHealthWatch_MinInterval(t *testing.T) {
+	m := &Mock{}
+	options := makeResolverOptions(WithMinInterval(100 * time.Millisecond))
+	w := newHealthWatch(m, consulapi.HealthConnectRequest{Service: "blah"}, options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	if _, err := w.next(ctx); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if _, err := w.next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v; want %v", err, context.DeadlineExceeded)
+	}
+	if got := len(m.inputs); got > 3 {
+		t.Fatalf("got %v queries; want at most 3", got)
+	}
+}
+
+type HealthFunc func(ctx context.Context, input consulapi.HealthConnectRequest) (consulapi.HealthConnectResponse, error)
+
+func (fn HealthFunc) ConnectQuery(ctx context.Context, input consulapi.HealthConnectRequest) (consulapi.HealthConnectResponse, error) {
+	return fn(ctx, input)
+}
+
+func (fn HealthFunc) Connect(ctx context.Context, service string, passing bool) ([]consulapi.HealthServiceEntry, error) {
+	output, err := fn(ctx, consulapi.HealthConnectRequest{Service: service, Passing: passing})
+	return output.Entries, err
+}
+
+func TestHealthWatch_Failover(t *testing.T) {
+	entry := func(id, dc string) consulapi.HealthServiceEntry {
+		return consulapi.HealthServiceEntry{
+			Node:    consulapi.HealthNode{Datacenter: dc},
+			Service: consulapi.HealthService{ID: id, Address: id, Port: 80},
+		}
+	}
+
+	// steps are the instances of each datacenter over time
+	steps := []map[string][]consulapi.HealthServiceEntry{
+		{"": {entry("a", "dc1")}, "dc2": {entry("b", "dc2")}},
+		{"": nil, "dc2": {entry("b", "dc2")}, "dc3": {entry("c", "dc3")}},
+		{"": nil, "dc2": nil, "dc3": {entry("c", "dc3")}},
+		{"": {entry("a", "dc1")}, "dc2": nil, "dc3": {entry("c", "dc3")}},
+	}
+
+	var (
+		step   int
+		inputs []consulapi.HealthConnectRequest
+	)
+	fn := HealthFunc(func(ctx context.Context, input consulapi.HealthConnectRequest) (consulapi.HealthConnectResponse, error) {
+		inputs = append(inputs, input)
+		if input.Datacenter == "" {
+			step++ // each pass begins with the local datacenter
+		}
+		return consulapi.HealthConnectResponse{Entries: steps[step-1][input.Datacenter]}, nil
+	})
+
+	r := NewResolver(fn, "svc", WithFailoverDatacenters("dc2", "dc3"), WithMinInterval(time.Millisecond))
+	w, err := r.Resolve("")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	defer w.Close()
+
+	want := [][]*naming.Update{
+		{{Op: naming.Add, Addr: "a:80", Metadata: &Instance{ID: "a", Datacenter: "dc1", Weight: 1}}},
+		{
+			{Op: naming.Delete, Addr: "a:80", Metadata: &Instance{ID: "a", Datacenter: "dc1", Weight: 1}},
+			{Op: naming.Add, Addr: "b:80", Metadata: &Instance{ID: "b", Datacenter: "dc2", Weight: 1}},
+		},
+		{
+			{Op: naming.Delete, Addr: "b:80", Metadata: &Instance{ID: "b", Datacenter: "dc2", Weight: 1}},
+			{Op: naming.Add, Addr: "c:80", Metadata: &Instance{ID: "c", Datacenter: "dc3", Weight: 1}},
+		},
+		{
+			{Op: naming.Add, Addr: "a:80", Metadata: &Instance{ID: "a", Datacenter: "dc1", Weight: 1}},
+			{Op: naming.Delete, Addr: "c:80", Metadata: &Instance{ID: "c", Datacenter: "dc3", Weight: 1}},
+		},
+	}
+	for i := range want {
+		got, err := w.Next()
+		if err != nil {
+			t.Fatalf("got %v; want nil", err)
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Fatalf("step %v: got %v; want %v", i, got, want[i])
+		}
+	}
+
+	// once failed over (after the query of dc2 in step 2), the local
+	// datacenter is watched with a shorter wait and the failover datacenters
+	// are not blocked on
+	for _, input := range inputs[3:] {
+		switch {
+		case input.Datacenter != "" && input.WaitTime != 0:
+			t.Fatalf("got %v; want 0", input.WaitTime)
+		case input.Datacenter == "" && input.WaitTime != failoverWaitTime:
+			t.Fatalf("got %v; want %v", input.WaitTime, failoverWaitTime)
+		}
+	}
+}
+
+func TestHealthWatch_Nearest(t *testing.T) {
+	var (
+		a = consulapi.HealthServiceEntry{Service: consulapi.HealthService{ID: "a", Address: "10.0.0.1", Port: 1}}
+		b = consulapi.HealthServiceEntry{Service: consulapi.HealthService{ID: "b", Address: "10.0.0.2", Port: 1}}
+		c = consulapi.HealthServiceEntry{Service: consulapi.HealthService{ID: "c", Address: "10.0.0.3", Port: 1}}
+	)
+
+	m := &Mock{entries: [][]consulapi.HealthServiceEntry{{c, a, b}}}
+	options := makeResolverOptions(WithNearest(2))
+	w := newHealthWatch(m, options.request("blah"), options)
+
+	got, err := w.next(context.Background())
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if want := []consulapi.HealthServiceEntry{c, a}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := m.inputs[0].Near, "_agent"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
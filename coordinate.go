@@ -0,0 +1,134 @@
+package consulapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var errDimensionMismatch = errors.New("coordinates have different dimensions")
+
+// NetworkCoordinate is a Vivaldi network coordinate as maintained by the
+// consul agents.
+type NetworkCoordinate struct {
+	Vec        []float64
+	Error      float64
+	Adjustment float64
+	Height     float64
+}
+
+// RTT returns the estimated round trip time between the two coordinates.
+func (c NetworkCoordinate) RTT(other NetworkCoordinate) (time.Duration, error) {
+	if len(c.Vec) != len(other.Vec) {
+		return 0, errDimensionMismatch
+	}
+
+	var sum float64
+	for i := range c.Vec {
+		diff := c.Vec[i] - other.Vec[i]
+		sum += diff * diff
+	}
+
+	// the adjustment terms are only applied when the result stays positive
+	dist := math.Sqrt(sum) + c.Height + other.Height
+	if adjusted := dist + c.Adjustment + other.Adjustment; adjusted > 0 {
+		dist = adjusted
+	}
+
+	return time.Duration(dist * float64(time.Second)), nil
+}
+
+type CoordinateEntry struct {
+	Node    string
+	Segment string `json:",omitempty"`
+	Coord   *NetworkCoordinate
+}
+
+type CoordinateDatacenterMap struct {
+	Datacenter  string
+	AreaID      string
+	Coordinates []CoordinateEntry
+}
+
+type Coordinate struct {
+	client *client
+}
+
+// Datacenters returns the WAN coordinates of the servers of each datacenter.
+func (c *Coordinate) Datacenters(ctx context.Context) ([]CoordinateDatacenterMap, error) {
+	const path = "/v1/coordinate/datacenters"
+	resp, err := c.client.Request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAgentError(resp)
+	}
+
+	var output []CoordinateDatacenterMap
+	if err := json.NewDecoder(resp.Body).Decode(&output); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// Nodes returns the LAN coordinates of the nodes in the local datacenter.
+func (c *Coordinate) Nodes(ctx context.Context) ([]CoordinateEntry, error) {
+	const path = "/v1/coordinate/nodes"
+	return c.entries(ctx, path)
+}
+
+// Node returns the LAN coordinates of node, one per network segment.
+func (c *Coordinate) Node(ctx context.Context, node string) ([]CoordinateEntry, error) {
+	path := "/v1/coordinate/node/" + url.PathEscape(node)
+	return c.entries(ctx, path)
+}
+
+func (c *Coordinate) entries(ctx context.Context, path string) ([]CoordinateEntry, error) {
+	resp, err := c.client.Request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAgentError(resp)
+	}
+
+	var output []CoordinateEntry
+	if err := json.NewDecoder(resp.Body).Decode(&output); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// Update sets the LAN coordinate of a node.
+func (c *Coordinate) Update(ctx context.Context, entry CoordinateEntry) error {
+	const path = "/v1/coordinate/update"
+	resp, err := c.client.Request(ctx, http.MethodPut, path, entry)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newAgentError(resp)
+	}
+
+	return nil
+}
+
+func NewCoordinate(opts ...Option) *Coordinate {
+	client := newClient(opts...)
+	return &Coordinate{
+		client: client,
+	}
+}
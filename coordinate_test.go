@@ -0,0 +1,142 @@
+package consulapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNetworkCoordinate_RTT(t *testing.T) {
+	testCases := map[string]struct {
+		A, B NetworkCoordinate
+		Want time.Duration
+	}{
+		"origin": {
+			A:    NetworkCoordinate{Vec: []float64{0, 0}},
+			B:    NetworkCoordinate{Vec: []float64{0, 0}},
+			Want: 0,
+		},
+		"euclidean plus heights": {
+			A:    NetworkCoordinate{Vec: []float64{0.003, 0}, Height: 0.001},
+			B:    NetworkCoordinate{Vec: []float64{0, 0.004}, Height: 0.002},
+			Want: 8 * time.Millisecond,
+		},
+		"adjustment": {
+			A:    NetworkCoordinate{Vec: []float64{0.003, 0}, Adjustment: 0.001},
+			B:    NetworkCoordinate{Vec: []float64{0, 0.004}, Adjustment: 0.001},
+			Want: 7 * time.Millisecond,
+		},
+		"negative adjustment ignored": {
+			A:    NetworkCoordinate{Vec: []float64{0.003, 0}, Adjustment: -0.004},
+			B:    NetworkCoordinate{Vec: []float64{0, 0.004}, Adjustment: -0.004},
+			Want: 5 * time.Millisecond,
+		},
+	}
+
+	for label, tc := range testCases {
+		t.Run(label, func(t *testing.T) {
+			got, err := tc.A.RTT(tc.B)
+			if err != nil {
+				t.Fatalf("got %v; want nil", err)
+			}
+			if diff := got - tc.Want; diff < -time.Microsecond || diff > time.Microsecond {
+				t.Fatalf("got %v; want %v", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestNetworkCoordinate_RTTDimensionMismatch(t *testing.T) {
+	a := NetworkCoordinate{Vec: []float64{0, 0}}
+	b := NetworkCoordinate{Vec: []float64{0, 0, 0}}
+	if _, err := a.RTT(b); err != errDimensionMismatch {
+		t.Fatalf("got %v; want %v", err, errDimensionMismatch)
+	}
+}
+
+func TestCoordinate(t *testing.T) {
+	var (
+		entry   = CoordinateEntry{Node: "node-1", Coord: &NetworkCoordinate{Vec: []float64{0.1, 0.2}, Height: 0.01}}
+		updated CoordinateEntry
+	)
+	addr := newTestServer(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.Path {
+		case "GET /v1/coordinate/datacenters":
+			json.NewEncoder(w).Encode([]CoordinateDatacenterMap{{Datacenter: "east", Coordinates: []CoordinateEntry{entry}}})
+		case "GET /v1/coordinate/nodes", "GET /v1/coordinate/node/node-1":
+			json.NewEncoder(w).Encode([]CoordinateEntry{entry})
+		case "PUT /v1/coordinate/update":
+			json.NewDecoder(req.Body).Decode(&updated)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+
+	var (
+		ctx        = context.Background()
+		coordinate = NewCoordinate(WithConsulAddr(addr))
+	)
+
+	datacenters, err := coordinate.Datacenters(ctx)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := datacenters, []CoordinateDatacenterMap{{Datacenter: "east", Coordinates: []CoordinateEntry{entry}}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	nodes, err := coordinate.Nodes(ctx)
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := nodes, []CoordinateEntry{entry}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	node, err := coordinate.Node(ctx, "node-1")
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := node, []CoordinateEntry{entry}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+
+	if err := coordinate.Update(ctx, entry); err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+	if got, want := updated, entry; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestCoordinate_AgentError(t *testing.T) {
+	addr := newTestServer(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	})
+
+	var (
+		ctx        = context.Background()
+		coordinate = NewCoordinate(WithConsulAddr(addr))
+	)
+
+	_, datacentersErr := coordinate.Datacenters(ctx)
+	_, nodesErr := coordinate.Nodes(ctx)
+	_, nodeErr := coordinate.Node(ctx, "node-1")
+	updateErr := coordinate.Update(ctx, CoordinateEntry{Node: "node-1"})
+
+	for _, err := range []error{datacentersErr, nodesErr, nodeErr, updateErr} {
+		agentErr, ok := err.(*AgentError)
+		if !ok {
+			t.Fatalf("got %v; want *AgentError", err)
+		}
+		if got, want := agentErr.StatusCode, http.StatusForbidden; got != want {
+			t.Fatalf("got %v; want %v", got, want)
+		}
+		if got, want := agentErr.Message, "Permission denied"; got != want {
+			t.Fatalf("got %v; want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package consulapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// AgentError is returned when the consul agent rejects a request.
+type AgentError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *AgentError) Error() string {
+	return fmt.Sprintf("consul agent returned %v: %v", e.StatusCode, e.Message)
+}
+
+func newAgentError(resp *http.Response) *AgentError {
+	data, _ := ioutil.ReadAll(resp.Body)
+	return &AgentError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(data)),
+	}
+}
+
+// IsUnknown reports whether err indicates the agent does not know the
+// service or check of a request, as happens when the agent restarts without
+// its state.  Agents without acls report an update of a lost ttl check as
+// the check not having a ttl.
+func IsUnknown(err error) bool {
+	e, ok := err.(*AgentError)
+	if !ok {
+		return false
+	}
+	if e.StatusCode == http.StatusNotFound {
+		return true
+	}
+
+	message := strings.ToLower(e.Message)
+	return strings.Contains(message, "unknown check") ||
+		strings.Contains(message, "unknown service") ||
+		strings.Contains(message, "does not have associated ttl")
+}
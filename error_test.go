@@ -0,0 +1,38 @@
+package consulapi
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestIsUnknown(t *testing.T) {
+	testCases := map[string]struct {
+		Err  error
+		Want bool
+	}{
+		"nil":       {Err: nil, Want: false},
+		"other":     {Err: errors.New("connection refused"), Want: false},
+		"not found": {Err: &AgentError{StatusCode: http.StatusNotFound}, Want: true},
+		"check": {
+			Err:  &AgentError{StatusCode: http.StatusInternalServerError, Message: `Unknown check ID "abc". Ensure that the check ID is passed, not the check name.`},
+			Want: true,
+		},
+		"ttl": {
+			Err:  &AgentError{StatusCode: http.StatusInternalServerError, Message: `CheckID "abc" does not have associated TTL`},
+			Want: true,
+		},
+		"outage": {
+			Err:  &AgentError{StatusCode: http.StatusInternalServerError, Message: "rpc error: No cluster leader"},
+			Want: false,
+		},
+	}
+
+	for label, tc := range testCases {
+		t.Run(label, func(t *testing.T) {
+			if got, want := IsUnknown(tc.Err), tc.Want; got != want {
+				t.Fatalf("got %v; want %v", got, want)
+			}
+		})
+	}
+}
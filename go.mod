@@ -1,3 +1,5 @@
 module github.com/savaki/consulapi
 
-require google.golang.org/grpc v1.16.0
+go 1.15
+
+require google.golang.org/grpc v1.29.1
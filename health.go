@@ -3,19 +3,83 @@ package consulapi
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 )
 
+type HealthNode struct {
+	ID         string
+	Node       string
+	Address    string
+	Datacenter string
+}
+
+// HealthServiceWeights are the load balancing weights of an instance while
+// its checks are passing and while any of them is warning.
+type HealthServiceWeights struct {
+	Passing int
+	Warning int
+}
+
 type HealthService struct {
 	ID      string
 	Service string
+	Tags    []string
+	Meta    map[string]string
 	Address string
 	Port    int
+	Weights HealthServiceWeights
+}
+
+type HealthCheck struct {
+	Node        string
+	CheckID     string
+	Name        string
+	Status      Status
+	Notes       string
+	Output      string
+	ServiceID   string
+	ServiceName string
 }
 
 type HealthServiceEntry struct {
+	Node    HealthNode
 	Service HealthService
+	Checks  []HealthCheck
+}
+
+// Warning reports whether any check of the entry is in the warning state.
+func (e HealthServiceEntry) Warning() bool {
+	for _, check := range e.Checks {
+		if check.Status == StatusWarn {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthConnectRequest selects the connect capable instances of a service.
+// When Near is set to a node name, or _agent for the node of the agent, the
+// instances are sorted by their estimated round trip time from that node.
+// When WaitIndex is set, the request blocks until the index of the result
+// exceeds WaitIndex or WaitTime elapses.
+type HealthConnectRequest struct {
+	Service    string
+	Passing    bool
+	Tags       []string
+	NodeMeta   map[string]string
+	Filter     string
+	Datacenter string
+	Near       string
+	WaitIndex  int64
+	WaitTime   time.Duration
+}
+
+type HealthConnectResponse struct {
+	Entries []HealthServiceEntry
+	Index   int64
 }
 
 type Health struct {
@@ -23,19 +87,57 @@ type Health struct {
 }
 
 func (h *Health) Connect(ctx context.Context, service string, passing bool) ([]HealthServiceEntry, error) {
-	path := fmt.Sprintf("/v1/health/connect/%v?passing=%v", service, passing)
-	resp, err := h.client.Request(ctx, http.MethodGet, path, nil)
+	output, err := h.ConnectQuery(ctx, HealthConnectRequest{
+		Service: service,
+		Passing: passing,
+	})
 	if err != nil {
 		return nil, err
 	}
+
+	return output.Entries, nil
+}
+
+func (h *Health) ConnectQuery(ctx context.Context, input HealthConnectRequest) (HealthConnectResponse, error) {
+	query := url.Values{}
+	query.Set("passing", strconv.FormatBool(input.Passing))
+	for _, tag := range input.Tags {
+		query.Add("tag", tag)
+	}
+	for key, value := range input.NodeMeta {
+		query.Add("node-meta", key+":"+value)
+	}
+	if input.Filter != "" {
+		query.Set("filter", input.Filter)
+	}
+	if input.Datacenter != "" {
+		query.Set("dc", input.Datacenter)
+	}
+	if input.Near != "" {
+		query.Set("near", input.Near)
+	}
+	setWait(query, input.WaitIndex, input.WaitTime)
+
+	path := "/v1/health/connect/" + url.PathEscape(input.Service) + "?" + query.Encode()
+	resp, err := h.client.Request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return HealthConnectResponse{}, err
+	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return HealthConnectResponse{}, newAgentError(resp)
+	}
+
 	var entries []HealthServiceEntry
 	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
-		return nil, err
+		return HealthConnectResponse{}, err
 	}
 
-	return entries, nil
+	return HealthConnectResponse{
+		Entries: entries,
+		Index:   parseIndex(resp),
+	}, nil
 }
 
 func NewHealth(opts ...Option) *Health {
@@ -5,6 +5,11 @@ import (
 	"encoding/hex"
 	"log"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -82,3 +87,79 @@ func TestHealth(t *testing.T) {
 		t.Fatalf("got %v; want != 0", got)
 	}
 }
+
+// newTestServer returns the address of a server that handles requests as
+// the consul agent would with fn.
+func newTestServer(t *testing.T, fn http.HandlerFunc) string {
+	server := httptest.NewServer(fn)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestHealth_ConnectQueryError(t *testing.T) {
+	addr := newTestServer(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "No path to datacenter", http.StatusInternalServerError)
+	})
+
+	_, err := NewHealth(WithConsulAddr(addr)).ConnectQuery(context.Background(), HealthConnectRequest{Service: "db", Datacenter: "nowhere"})
+	agentErr, ok := err.(*AgentError)
+	if !ok {
+		t.Fatalf("got %v; want *AgentError", err)
+	}
+	if got, want := agentErr.StatusCode, http.StatusInternalServerError; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := agentErr.Message, "No path to datacenter"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}
+
+func TestHealth_ConnectQuery(t *testing.T) {
+	var (
+		path  string
+		query url.Values
+	)
+	addr := newTestServer(t, func(w http.ResponseWriter, req *http.Request) {
+		path, query = req.URL.Path, req.URL.Query()
+		w.Header().Set("X-Consul-Index", "43")
+		w.Write([]byte(`[{"Service":{"ID":"db-1"}}]`))
+	})
+
+	output, err := NewHealth(WithConsulAddr(addr)).ConnectQuery(context.Background(), HealthConnectRequest{
+		Service:    "db",
+		Passing:    true,
+		Tags:       []string{"v2", "canary"},
+		NodeMeta:   map[string]string{"rack": "r1"},
+		Filter:     `Service.Meta.version == "2"`,
+		Datacenter: "east",
+		Near:       "_agent",
+		WaitIndex:  42,
+		WaitTime:   5 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("got %v; want nil", err)
+	}
+
+	if got, want := path, "/v1/health/connect/db"; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	want := url.Values{
+		"passing":   {"true"},
+		"tag":       {"v2", "canary"},
+		"node-meta": {"rack:r1"},
+		"filter":    {`Service.Meta.version == "2"`},
+		"dc":        {"east"},
+		"near":      {"_agent"},
+		"index":     {"42"},
+		"wait":      {"300000ms"},
+	}
+	if !reflect.DeepEqual(query, want) {
+		t.Fatalf("got %v; want %v", query, want)
+	}
+	if got, want := output.Index, int64(43); got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if got, want := len(output.Entries), 1; got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+}